@@ -0,0 +1,209 @@
+package charter
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var ErrArchiveTooLarge = errors.New("directory too large to archive")
+
+// archiveFormat is a kind of archive that a directory can be downloaded as, by
+// retrieving the directory's name with the format's suffix appended.
+type archiveFormat struct {
+	suffix string
+	write  func(w io.Writer, realDir, name string) error
+}
+
+var archiveFormats = []archiveFormat{
+	{".zip", writeZip},
+	{".tar.gz", writeTarGz},
+	{".tgz", writeTarGz},
+}
+
+// archiveSource is the directory from which an archive download is generated.
+type archiveSource struct {
+	realDir string
+	name    string // The directory's name, and that of the archive's top-level entry.
+	format  *archiveFormat
+}
+
+// archiveSourceFor reports whether paramPath, which doesn't exist itself, names a
+// directory with an archive suffix appended, and if so, returns the directory
+// to archive. Archive downloads must be enabled for the user.
+func (client *Client) archiveSourceFor(paramPath string) (archiveSource, bool) {
+	if !client.server.config.Users[client.username].ArchiveDownloads {
+		return archiveSource{}, false
+	}
+
+	for i := range archiveFormats {
+		format := &archiveFormats[i]
+		if !strings.HasSuffix(strings.ToLower(paramPath), format.suffix) {
+			continue
+		}
+
+		dir := paramPath[:len(paramPath)-len(format.suffix)]
+		if dir == "" || strings.HasSuffix(dir, "/") {
+			continue
+		}
+		realDir, err := client.realPath(dir)
+		if err != nil {
+			continue
+		}
+		if stat, err := os.Stat(realDir); err == nil && stat.IsDir() {
+			return archiveSource{
+				realDir: realDir,
+				name:    path.Base(client.virtualPath(dir)),
+				format:  format,
+			}, true
+		}
+	}
+
+	return archiveSource{}, false
+}
+
+// walkArchive calls fn for each directory and regular file under realDir,
+// with the entry's name in the archive: its path relative to realDir, below a
+// top-level directory called name. Symbolic links and special files are left
+// out, so the archive never includes anything from outside the tree.
+func walkArchive(realDir, name string, fn func(p, entry string, fi os.FileInfo) error) error {
+	return filepath.Walk(realDir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(realDir, p)
+		if err != nil {
+			return err
+		}
+		entry := path.Join(name, filepath.ToSlash(rel))
+		if fi.IsDir() {
+			entry += "/"
+		}
+		return fn(p, entry, fi)
+	})
+}
+
+// copyEntry copies the contents of the file at p below realDir, as recorded in
+// fi, to w. The file is cut short or padded with zeros if it changed size
+// since, since the size was already written to the archive.
+func copyEntry(w io.Writer, realDir, p string, fi os.FileInfo) error {
+	f, err := openBeneath(realDir, p, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := io.CopyN(w, f, fi.Size())
+	if err == io.EOF {
+		_, err = io.CopyN(w, zeroReader{}, fi.Size()-n)
+	}
+	return err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func writeZip(w io.Writer, realDir, name string) error {
+	zw := zip.NewWriter(w)
+	err := walkArchive(realDir, name, func(p, entry string, fi os.FileInfo) error {
+		hdr, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		hdr.Name = entry
+		if !fi.IsDir() {
+			hdr.Method = zip.Deflate
+		}
+
+		ew, err := zw.CreateHeader(hdr)
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		return copyEntry(ew, realDir, p, fi)
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeTarGz(w io.Writer, realDir, name string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err := walkArchive(realDir, name, func(p, entry string, fi os.FileInfo) error {
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = entry
+
+		if err := tw.WriteHeader(hdr); err != nil || fi.IsDir() {
+			return err
+		}
+		return copyEntry(tw, realDir, p, fi)
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// sendArchive streams an archive of src over the data connection, generating
+// it as it goes.
+func sendArchive(client *Client, paramPath string, src archiveSource, offset int64) {
+	if offset > 0 {
+		_ = client.sendReply(554, "Can't resume %s: archives are generated on the fly", paramPath)
+		return
+	}
+
+	if max := client.server.config.ArchiveMaxSize; max > 0 {
+		size, _, err := treeUsage(src.realDir)
+		if err != nil {
+			_ = client.sendReply(550, "Can't archive %s: %v", paramPath, pathErr(err))
+			return
+		} else if size > max {
+			_ = client.sendReply(550, "Can't archive %s: %v", paramPath, ErrArchiveTooLarge)
+			return
+		}
+	}
+
+	if !client.ensureDataConn() {
+		return
+	}
+	defer client.dataConn.Close()
+
+	_ = client.sendReply(150, "Opening BINARY mode data connection for %s (archive of %s)", paramPath, src.name)
+	w := client.dataWriter()
+	err := src.format.write(w, src.realDir, src.name)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = client.dataConn.Close()
+	}
+	if err != nil {
+		_ = client.sendReply(426, "Connection closed; transfer aborted")
+		return
+	}
+
+	_ = client.sendReply(226, "Transfer complete")
+}
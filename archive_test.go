@@ -0,0 +1,83 @@
+package charter
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveDownload(t *testing.T) {
+	outside, err := ioutil.TempDir("", "charter-outside")
+	assert.Nil(t, err)
+	defer os.RemoveAll(outside)
+
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.Users = map[string]UserConf{"alice": {ArchiveDownloads: true}}
+	})
+	defer cleanup()
+
+	makeTree(t, s.root)
+	assert.Nil(t, os.Symlink(outside, filepath.Join(s.root, "project/docs/outside")))
+
+	s.expect("TYPE I", 200)
+	code, data := s.transfer("RETR project.zip", nil)
+	assert.Equal(t, 226, code)
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.Nil(t, err)
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{"project/", "project/README", "project/docs/", "project/src/",
+		"project/src/main.go", "project/src/pkg/", "project/src/pkg/lib.go"}, names)
+
+	code, data = s.transfer("RETR project.tar.gz", nil)
+	assert.Equal(t, 226, code)
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	assert.Nil(t, err)
+	tr := tar.NewReader(gr)
+	contents := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		b, _ := ioutil.ReadAll(tr)
+		contents[hdr.Name] = string(b)
+	}
+	assert.Equal(t, "data", contents["project/src/pkg/lib.go"])
+	assert.Len(t, contents, 7)
+
+	s.expect("RETR missing.zip", 550)
+	s.expect("RETR .zip", 550)
+}
+
+func TestArchiveDownloadRestricted(t *testing.T) {
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.ArchiveMaxSize = 10
+		config.Users = map[string]UserConf{"alice": {ArchiveDownloads: true}}
+	})
+	defer cleanup()
+
+	makeTree(t, s.root)
+	s.expect("RETR project.zip", 550)
+	code, _ := s.transfer("RETR project/src/pkg.tgz", nil)
+	assert.Equal(t, 226, code)
+}
+
+func TestArchiveDownloadDisabled(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	makeTree(t, s.root)
+	s.expect("RETR project.zip", 550)
+}
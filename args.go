@@ -0,0 +1,493 @@
+package charter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnsupportedParam is returned by argument parsers for arguments that are
+// well-formed but name a parameter the server doesn't implement.
+var ErrUnsupportedParam = errors.New("command not implemented for that parameter")
+
+// argParser validates the raw argument of a command and converts it into a
+// typed value, which is passed to the command's handler in FtpCommand.Value.
+type argParser func(arg string) (interface{}, error)
+
+// typeArg is the argument of TYPE.
+type typeArg struct {
+	dataType dataType
+	format   byte // Format control for ASCII, 'N' if unspecified.
+}
+
+// parseType parses the argument of TYPE: A [N], I, or L 8. The Telnet and
+// carriage control formats, EBCDIC, and byte sizes other than 8 aren't
+// supported.
+func parseType(arg string) (interface{}, error) {
+	fields := strings.Fields(strings.ToUpper(arg))
+	if len(fields) == 0 || len(fields) > 2 || len(fields[0]) != 1 {
+		return nil, fmt.Errorf("invalid type: %s", arg)
+	}
+
+	switch fields[0] {
+	case "A":
+		format := byte('N')
+		if len(fields) == 2 {
+			if len(fields[1]) != 1 || !strings.Contains("NTC", fields[1]) {
+				return nil, fmt.Errorf("invalid format control: %s", fields[1])
+			}
+			format = fields[1][0]
+		}
+		if format != 'N' {
+			return nil, ErrUnsupportedParam
+		}
+		return typeArg{dataType: TypeASCII, format: format}, nil
+	case "I":
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("invalid type: %s", arg)
+		}
+		return typeArg{dataType: TypeImage}, nil
+	case "L":
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("missing byte size: %s", arg)
+		}
+		size, err := strconv.Atoi(fields[1])
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid byte size: %s", fields[1])
+		}
+		if size != 8 {
+			return nil, ErrUnsupportedParam
+		}
+		return typeArg{dataType: TypeImage}, nil
+	case "E":
+		return nil, ErrUnsupportedParam
+	}
+
+	return nil, fmt.Errorf("invalid type: %s", arg)
+}
+
+// parseMode parses the argument of MODE: S, B, C or Z.
+func parseMode(arg string) (interface{}, error) {
+	switch strings.ToUpper(strings.TrimSpace(arg)) {
+	case "S":
+		return ModeStream, nil
+	case "B":
+		return ModeBlock, nil
+	case "C":
+		return ModeCompressed, nil
+	case "Z":
+		return ModeDeflate, nil
+	}
+
+	return nil, fmt.Errorf("invalid mode: %s", arg)
+}
+
+// fileStructure is the argument of STRU.
+type fileStructure int
+
+const (
+	StructureFile fileStructure = iota
+	StructureRecord
+	StructurePage
+)
+
+func (stru fileStructure) String() string {
+	switch stru {
+	case StructureRecord:
+		return "R"
+	case StructurePage:
+		return "P"
+	}
+	return "F"
+}
+
+// parseStru parses the argument of STRU: F, R or P.
+func parseStru(arg string) (interface{}, error) {
+	switch strings.ToUpper(strings.TrimSpace(arg)) {
+	case "F":
+		return StructureFile, nil
+	case "R":
+		return StructureRecord, nil
+	case "P":
+		return StructurePage, nil
+	}
+
+	return nil, fmt.Errorf("invalid structure: %s", arg)
+}
+
+// parseHostPort parses the argument of PORT, h1,h2,h3,h4,p1,p2, into the
+// address it describes.
+func parseHostPort(arg string) (interface{}, error) {
+	fields := strings.Split(strings.TrimSpace(arg), ",")
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("invalid host-port: %s", arg)
+	}
+
+	var b [6]byte
+	for i, field := range fields {
+		n, err := strconv.ParseUint(strings.TrimSpace(field), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host-port: %s", arg)
+		}
+		b[i] = byte(n)
+	}
+
+	return &net.TCPAddr{
+		IP:   net.IPv4(b[0], b[1], b[2], b[3]),
+		Port: int(b[4])<<8 | int(b[5]),
+	}, nil
+}
+
+// parseOffset parses the argument of REST, a non-negative byte offset.
+func parseOffset(arg string) (interface{}, error) {
+	offset, err := strconv.ParseInt(strings.TrimSpace(arg), 10, 64)
+	if err != nil || offset < 0 {
+		return nil, fmt.Errorf("invalid restart offset: %s", arg)
+	}
+
+	return offset, nil
+}
+
+// splitListArg splits the argument of LIST or NLST into the ls(1)-style
+// options preceding the pathname, and the pathname itself.
+func splitListArg(arg string) (opts string, pathname string) {
+	for strings.HasPrefix(arg, "-") {
+		i := strings.IndexByte(arg, ' ')
+		if i < 0 {
+			return opts + arg[1:], ""
+		}
+
+		opts += arg[1:i]
+		arg = strings.TrimLeft(arg[i:], " ")
+	}
+
+	return opts, arg
+}
+
+// byteRange is a range of bytes in a file, from start to end inclusive. An end
+// of -1 stands for the end of the file.
+type byteRange struct {
+	start, end int64
+}
+
+// parseRange parses the argument of RANG: a start and an end point, inclusive.
+// "1 0" is accepted as the request to reset the range.
+func parseRange(arg string) (interface{}, error) {
+	fields := strings.Fields(arg)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid range: %s", arg)
+	}
+
+	start, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || start < 0 {
+		return nil, fmt.Errorf("invalid start point: %s", fields[0])
+	}
+	end, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || end < 0 {
+		return nil, fmt.Errorf("invalid end point: %s", fields[1])
+	}
+	if end < start && !(start == 1 && end == 0) {
+		return nil, fmt.Errorf("invalid range: %s", arg)
+	}
+
+	return byteRange{start: start, end: end}, nil
+}
+
+// hashArg is the argument of XCRC, XMD5, XSHA1 and XSHA256.
+type hashArg struct {
+	path string
+	rng  byteRange
+}
+
+// parseHashArg parses the argument of the XCRC family of commands: a pathname,
+// optionally followed by a start and an end point. A pathname containing spaces
+// may be quoted, which also sets it apart from the range.
+func parseHashArg(arg string) (interface{}, error) {
+	pathname, rest := arg, ""
+	if strings.HasPrefix(arg, "\"") {
+		i := strings.IndexByte(arg[1:], '"')
+		if i < 0 {
+			return nil, fmt.Errorf("unterminated quoted pathname: %s", arg)
+		}
+		pathname, rest = arg[1:i+1], arg[i+2:]
+	} else if fields := strings.Fields(arg); len(fields) >= 3 {
+		// Only take trailing numbers as a range if there are two of them.
+		if _, err := parseRange(strings.Join(fields[len(fields)-2:], " ")); err == nil {
+			pathname = trimFields(arg, 2)
+			rest = arg[len(pathname):]
+		}
+	}
+
+	parsed := hashArg{path: pathname, rng: byteRange{start: 0, end: -1}}
+	switch fields := strings.Fields(rest); len(fields) {
+	case 0:
+	case 1:
+		start, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid start point: %s", fields[0])
+		}
+		parsed.rng.start = start
+	case 2:
+		rng, err := parseRange(rest)
+		if err != nil {
+			return nil, err
+		}
+		parsed.rng = rng.(byteRange)
+	default:
+		return nil, fmt.Errorf("invalid range: %s", rest)
+	}
+
+	if parsed.path == "" {
+		return nil, fmt.Errorf("missing pathname")
+	}
+	return parsed, nil
+}
+
+// trimFields removes the last n space-separated fields from s.
+func trimFields(s string, n int) string {
+	s = strings.TrimRight(s, " ")
+	for ; n > 0; n-- {
+		i := strings.LastIndexByte(s, ' ')
+		if i < 0 {
+			return ""
+		}
+		s = strings.TrimRight(s[:i], " ")
+	}
+	return s
+}
+
+// splitQuoted splits the first pathname off arg. A pathname containing spaces
+// may be quoted; otherwise, it ends at the first space.
+func splitQuoted(arg string) (pathname, rest string, err error) {
+	arg = strings.TrimLeft(arg, " ")
+	if strings.HasPrefix(arg, "\"") {
+		i := strings.IndexByte(arg[1:], '"')
+		if i < 0 {
+			return "", "", fmt.Errorf("unterminated quoted pathname: %s", arg)
+		}
+		return arg[1 : i+1], strings.TrimLeft(arg[i+2:], " "), nil
+	}
+
+	if i := strings.IndexByte(arg, ' '); i >= 0 {
+		return arg[:i], strings.TrimLeft(arg[i:], " "), nil
+	}
+	return arg, "", nil
+}
+
+// parsePathPair parses an argument consisting of two pathnames, as taken by
+// SITE SYMLINK. The first may be quoted; the second is the rest of the
+// argument.
+func parsePathPair(arg string) (interface{}, error) {
+	first, second, err := splitQuoted(arg)
+	if err != nil {
+		return nil, err
+	}
+	second = strings.Trim(second, "\"")
+	if first == "" || second == "" {
+		return nil, fmt.Errorf("expected two pathnames: %s", arg)
+	}
+
+	return [2]string{first, second}, nil
+}
+
+// chmodArg is the argument of SITE CHMOD.
+type chmodArg struct {
+	mode os.FileMode
+	path string
+}
+
+// parseChmod parses the argument of SITE CHMOD: an octal mode of at most 0777,
+// followed by a pathname.
+func parseChmod(arg string) (interface{}, error) {
+	modeStr, pathname, _ := splitQuoted(arg)
+	mode, err := strconv.ParseUint(modeStr, 8, 32)
+	if err != nil || mode > 0777 {
+		return nil, fmt.Errorf("invalid mode: %s", modeStr)
+	}
+	if pathname == "" {
+		return nil, fmt.Errorf("missing pathname")
+	}
+
+	return chmodArg{mode: os.FileMode(mode), path: pathname}, nil
+}
+
+// timeValLayout is the layout of the time-val of RFC 3659, section 2.3, which
+// is always in UTC.
+const timeValLayout = "20060102150405"
+
+// parseTimeVal parses a time-val, YYYYMMDDhhmmss with an optional fraction of a
+// second.
+func parseTimeVal(s string) (time.Time, error) {
+	whole := s
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole = s[:i]
+		if _, err := strconv.ParseUint(s[i+1:], 10, 32); err != nil || i+1 == len(s) {
+			return time.Time{}, fmt.Errorf("invalid time: %s", s)
+		}
+	}
+	if len(whole) != len(timeValLayout) {
+		return time.Time{}, fmt.Errorf("invalid time: %s", s)
+	}
+
+	// A fractional second following the seconds is accepted by time.Parse even
+	// though the layout has none.
+	t, err := time.Parse(timeValLayout, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time: %s", s)
+	}
+	return t, nil
+}
+
+// utimeArg is the argument of SITE UTIME.
+type utimeArg struct {
+	path         string
+	atime, mtime time.Time
+}
+
+// parseUtime parses the argument of SITE UTIME, in either of the forms in
+// common use: "YYYYMMDDhhmm[ss] path", setting both times, or "path atime mtime
+// ctime UTC". The creation time of the latter can't be set, and is ignored.
+func parseUtime(arg string) (interface{}, error) {
+	fields := strings.Fields(arg)
+	if n := len(fields); n >= 5 && strings.EqualFold(fields[n-1], "UTC") {
+		atime, err := parseTimeVal(fields[n-4])
+		if err != nil {
+			return nil, err
+		}
+		mtime, err := parseTimeVal(fields[n-3])
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parseTimeVal(fields[n-2]); err != nil {
+			return nil, err
+		}
+
+		pathname := strings.Trim(trimFields(arg, 4), "\"")
+		if pathname == "" {
+			return nil, fmt.Errorf("missing pathname")
+		}
+		return utimeArg{path: pathname, atime: atime, mtime: mtime}, nil
+	}
+
+	stamp, pathname, err := splitQuoted(arg)
+	if err != nil {
+		return nil, err
+	}
+	if len(stamp) == len(timeValLayout)-2 {
+		stamp += "00"
+	}
+	mtime, err := parseTimeVal(stamp)
+	if err != nil {
+		return nil, err
+	}
+	pathname = strings.Trim(pathname, "\"")
+	if pathname == "" {
+		return nil, fmt.Errorf("missing pathname")
+	}
+
+	return utimeArg{path: pathname, atime: mtime, mtime: mtime}, nil
+}
+
+// timeArg is the argument of MFMT and MFCT.
+type timeArg struct {
+	time time.Time
+	path string
+}
+
+// parseTimeArg parses the argument of MFMT and MFCT: a time-val followed by a
+// pathname, which may contain spaces.
+func parseTimeArg(arg string) (interface{}, error) {
+	i := strings.IndexByte(arg, ' ')
+	if i < 0 {
+		return nil, fmt.Errorf("missing pathname")
+	}
+
+	t, err := parseTimeVal(arg[:i])
+	if err != nil {
+		return nil, err
+	}
+	return timeArg{time: t, path: arg[i+1:]}, nil
+}
+
+// fact is a fact of MFF, such as Modify or UNIX.mode, with its value.
+type fact struct {
+	name, value string
+}
+
+// mffArg is the argument of MFF.
+type mffArg struct {
+	facts []fact
+	path  string
+}
+
+// parseMff parses the argument of MFF: a list of facts, each terminated by a
+// semicolon, followed by a space and a pathname. Facts other than those in
+// mffFacts are rejected as unsupported.
+func parseMff(arg string) (interface{}, error) {
+	i := strings.IndexByte(arg, ' ')
+	if i < 0 || i == 0 || arg[i-1] != ';' {
+		return nil, fmt.Errorf("invalid facts: %s", arg)
+	}
+
+	parsed := mffArg{path: arg[i+1:]}
+	for _, f := range strings.Split(arg[:i-1], ";") {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid fact: %s", f)
+		}
+
+		name, ok := lookupFact(kv[0])
+		if !ok {
+			return nil, ErrUnsupportedParam
+		}
+		parsed.facts = append(parsed.facts, fact{name: name, value: kv[1]})
+	}
+
+	return parsed, nil
+}
+
+// extractArg is the argument of SITE UNZIP and SITE UNTAR.
+type extractArg struct {
+	archive string
+	dest    string // Empty to extract next to the archive.
+}
+
+// restoreArg is the argument of SITE RESTORE.
+type restoreArg struct {
+	name string
+	dest string // Empty to restore to the original path.
+}
+
+// parseRestoreArg parses the argument of SITE RESTORE: the name of an entry in
+// the trash, which may be quoted, optionally followed by the path to restore
+// it to.
+func parseRestoreArg(arg string) (interface{}, error) {
+	name, dest, err := splitQuoted(arg)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+
+	return restoreArg{name: name, dest: strings.Trim(dest, "\"")}, nil
+}
+
+// parseExtractArg parses the argument of SITE UNZIP and SITE UNTAR: the
+// pathname of an archive, which may be quoted, optionally followed by the
+// directory to extract it into.
+func parseExtractArg(arg string) (interface{}, error) {
+	archive, dest, err := splitQuoted(arg)
+	if err != nil {
+		return nil, err
+	}
+	if archive == "" {
+		return nil, fmt.Errorf("missing pathname")
+	}
+
+	return extractArg{archive: archive, dest: strings.Trim(dest, "\"")}, nil
+}
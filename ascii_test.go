@@ -0,0 +1,81 @@
+package charter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendASCII(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, sendASCII(&buf, strings.NewReader("a\nb\r\nc\n")))
+	assert.Equal(t, "a\r\nb\r\nc\r\n", buf.String())
+}
+
+func TestStoreASCII(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, storeASCII(&buf, strings.NewReader("a\r\nb\rc\r\n")))
+	assert.Equal(t, "a\nb\nc\n", buf.String())
+}
+
+func TestASCIIOffset(t *testing.T) {
+	text := "ab\ncd\n"
+
+	size, err := asciiOffset(strings.NewReader(text), -1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8), size)
+
+	tests := []struct {
+		n    int64
+		want int64
+		err  error
+	}{
+		{n: 0, want: 0},
+		{n: 2, want: 2},
+		{n: 3, err: ErrInvalidRestart},
+		{n: 4, want: 3},
+		{n: 8, want: 6},
+		{n: 9, err: ErrInvalidRestart},
+	}
+
+	for _, tt := range tests {
+		got, err := asciiOffset(strings.NewReader(text), tt.n)
+		assert.Equal(t, tt.err, err, "%d", tt.n)
+		assert.Equal(t, tt.want, got, "%d", tt.n)
+	}
+}
+
+func TestASCIITransfers(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	assert.Nil(t, ioutil.WriteFile(s.root+"/notes.txt", []byte("one\ntwo\n"), 0644))
+
+	s.expect("TYPE I", 200)
+	assert.Equal(t, "8", s.expect("SIZE notes.txt", 213))
+	_, data := s.transfer("RETR notes.txt", nil)
+	assert.Equal(t, "one\ntwo\n", string(data))
+
+	s.expect("TYPE A", 200)
+	assert.Equal(t, "10", s.expect("SIZE notes.txt", 213))
+	_, data = s.transfer("RETR notes.txt", nil)
+	assert.Equal(t, "one\r\ntwo\r\n", string(data))
+
+	s.expect("REST 5", 350)
+	_, data = s.transfer("RETR notes.txt", nil)
+	assert.Equal(t, "two\r\n", string(data))
+
+	s.transfer("STOR upload.txt", []byte("three\r\nfour\r\n"))
+	b, err := ioutil.ReadFile(s.root + "/upload.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "three\nfour\n", string(b))
+
+	s.expect("REST 7", 350)
+	s.transfer("STOR upload.txt", []byte("five\r\n"))
+	b, err = ioutil.ReadFile(s.root + "/upload.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "three\nfive\n", string(b))
+}
@@ -0,0 +1,130 @@
+package charter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+var ErrInvalidEncoding = errors.New("invalid pathname encoding")
+
+// languages lists the languages in which reply text is available, the first
+// being the default. See RFC 2640, section 4.
+var languages = []string{"EN"}
+
+// lookupCharset returns the encoding with the given IANA or WHATWG name, such
+// as "ISO-8859-1" or "Shift_JIS".
+func lookupCharset(name string) (encoding.Encoding, error) {
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil || enc == nil {
+		enc, err = htmlindex.Get(name)
+	}
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("unsupported charset: %s", name)
+	}
+
+	return enc, nil
+}
+
+// legacy reports whether the session uses the configured legacy charset
+// instead of UTF-8 on the control and data connections.
+func (client *Client) legacy() bool {
+	return !client.utf8 && client.server.charset != nil
+}
+
+// decodeLine converts a line read from the control connection into UTF-8.
+// Pathnames are left as sent: the resolver falls back to other Unicode
+// normalisation forms only for names that don't exist as given.
+func (client *Client) decodeLine(line string) (string, error) {
+	if client.legacy() {
+		decoded, err := client.server.charset.NewDecoder().String(line)
+		if err != nil {
+			return "", ErrInvalidEncoding
+		}
+		line = decoded
+	} else if !utf8.ValidString(line) {
+		return "", ErrInvalidEncoding
+	}
+
+	return line, nil
+}
+
+// encodeText converts text sent to the client into the session's charset.
+// Characters that can't be represented are replaced.
+func (client *Client) encodeText(text string) string {
+	if !client.legacy() {
+		return text
+	}
+
+	encoded, err := encoding.ReplaceUnsupported(client.server.charset.NewEncoder()).String(text)
+	if err != nil {
+		return text
+	}
+	return encoded
+}
+
+func utf8Feature(client *Client) string {
+	return "UTF8"
+}
+
+func utf8OptsHandler(client *Client, command FtpCommand) (isExiting bool) {
+	if command.Arg == "" {
+		_ = client.sendReply(501, "Missing argument to OPTS UTF8")
+		return
+	}
+
+	switch strings.ToUpper(strings.TrimSpace(command.Arg)) {
+	case "ON":
+		client.utf8 = true
+		_ = client.sendReply(200, "UTF8 mode enabled")
+	case "OFF":
+		if client.server.charset == nil {
+			_ = client.sendReply(200, "Always in UTF8 mode")
+		} else {
+			client.utf8 = false
+			_ = client.sendReply(200, "UTF8 mode disabled")
+		}
+	default:
+		_ = client.sendReply(501, "Option not understood for UTF8")
+	}
+	return
+}
+
+func langFeature(client *Client) string {
+	feats := make([]string, len(languages))
+	for i, lang := range languages {
+		feats[i] = lang
+		if lang == client.lang {
+			feats[i] += "*"
+		}
+	}
+
+	return "LANG " + strings.Join(feats, ";")
+}
+
+func langHandler(client *Client, command FtpCommand) (isExiting bool) {
+	if command.Arg == "" {
+		client.lang = languages[0]
+		_ = client.sendReply(200, "Language reset to %s", client.lang)
+		return
+	}
+
+	// Language tags are matched on their primary subtag, so that e.g. "en-US"
+	// selects English.
+	tag := strings.ToUpper(strings.SplitN(strings.TrimSpace(command.Arg), "-", 2)[0])
+	for _, lang := range languages {
+		if lang == tag {
+			client.lang = lang
+			_ = client.sendReply(200, "Language set to %s", lang)
+			return
+		}
+	}
+
+	_ = client.sendReply(504, "Language %s not supported", command.Arg)
+	return
+}
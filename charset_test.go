@@ -0,0 +1,80 @@
+package charter
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newCharsetClient(charset string) *Client {
+	srv := NewServer(&Config{Charset: charset})
+	return &Client{server: srv, utf8: srv.charset == nil}
+}
+
+func TestDecodeLineUTF8(t *testing.T) {
+	client := newCharsetClient("")
+
+	// Names are passed through as sent, whatever their normalisation form.
+	line, err := client.decodeLine("STOR Mu\u0308ller.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "STOR Mu\u0308ller.txt", line)
+
+	_, err = client.decodeLine("STOR M\xfcller.txt")
+	assert.Equal(t, ErrInvalidEncoding, err)
+}
+
+func TestDecomposedNames(t *testing.T) {
+	s, done := newTestSession(t, nil)
+	defer done()
+
+	if err := ioutil.WriteFile(filepath.Join(s.root, "cafe\u0301.txt"), []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s.expect("SIZE cafe\u0301.txt", 213)
+	s.expect("SIZE caf\u00e9.txt", 213)
+	s.expect("DELE cafe\u0301.txt", 250)
+	s.expect("SIZE cafe\u0301.txt", 550)
+
+	s.transfer("STOR cafe\u0301.txt", []byte("abc"))
+	_, err := ioutil.ReadFile(filepath.Join(s.root, "cafe\u0301.txt"))
+	assert.Nil(t, err)
+}
+
+func TestDecodeLineLegacy(t *testing.T) {
+	tests := []struct {
+		charset string
+		line    string
+		want    string
+	}{
+		{charset: "ISO-8859-1", line: "STOR M\xfcller.txt", want: "STOR Müller.txt"},
+		{charset: "Shift_JIS", line: "STOR \x93\xfa\x96\x7b.txt", want: "STOR 日本.txt"},
+	}
+
+	for _, tt := range tests {
+		client := newCharsetClient(tt.charset)
+		line, err := client.decodeLine(tt.line)
+		assert.Nil(t, err, tt.charset)
+		assert.Equal(t, tt.want, line, tt.charset)
+		assert.Equal(t, tt.line, client.encodeText(line), tt.charset)
+
+		// Once the client opts in to UTF-8, lines are no longer transcoded.
+		client.utf8 = true
+		line, err = client.decodeLine(tt.want)
+		assert.Nil(t, err, tt.charset)
+		assert.Equal(t, tt.want, line, tt.charset)
+		assert.Equal(t, tt.want, client.encodeText(line), tt.charset)
+	}
+}
+
+func TestLookupCharset(t *testing.T) {
+	for _, name := range []string{"ISO-8859-1", "latin1", "Shift_JIS", "shift-jis", "EUC-JP"} {
+		_, err := lookupCharset(name)
+		assert.Nil(t, err, name)
+	}
+
+	_, err := lookupCharset("klingon")
+	assert.NotNil(t, err)
+}
@@ -5,11 +5,17 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/textproto"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type Client struct {
@@ -17,25 +23,55 @@ type Client struct {
 	dataLis      net.Listener
 	dataConn     net.Conn
 	dataPort     uint16
+	activeAddr   *net.TCPAddr
 	dataType     dataType
 	mode         transmissionMode
+	structure    fileStructure
+	deflateLevel int
 	server       *Server
 	response     *bytes.Buffer
 	username     string
-	rootDir      string
+	mounts       mountTable
+	quotas       []*quota
+	restOffset   int64
+	renameFrom   string
+	copyFrom     string
+	hashAlgo     hashAlgorithm
+	hashRange    *byteRange
+	umask        os.FileMode
+	utf8         bool
+	lang         string
 	workingDir   string
-	isRegistered bool
+	state        sessionState
+
+	// replyMu serializes replies, which are sent both by the session and by the
+	// transfer running in the background.
+	replyMu sync.Mutex
+
+	transferMu sync.Mutex
+	transfer   *transfer
 }
 
 func (client *Client) handleConn() {
 	defer client.ctrlConn.Close()
+	defer client.abortTransfer()
 	r := textproto.NewReader(bufio.NewReader(client.ctrlConn))
+	if err := client.sendReply(220, "Service ready"); err != nil {
+		return
+	}
+
 	for {
 		line, err := r.ReadLine()
 		if err != nil {
 			break
 		}
 
+		line, err = client.decodeLine(stripTelnet(line))
+		if err != nil {
+			client.sendReply(501, "Invalid character encoding.")
+			continue
+		}
+
 		cmd, err := ParseLine(line)
 		if err == ErrLineIsEmpty {
 			continue
@@ -43,25 +79,67 @@ func (client *Client) handleConn() {
 			break
 		}
 
+		// While a transfer is in progress, only commands that act on it are
+		// handled straight away; anything else waits for it to finish.
 		upperCmd := strings.ToUpper(cmd.Command)
-		if !client.isRegistered && upperCmd != "USER" && upperCmd != "PASS" {
-			client.sendReply(530, "You aren't logged in.")
-			continue
+		srvCmd, ok := Commands[upperCmd]
+		if !srvCmd.urgent {
+			client.waitTransfer()
 		}
 
-		srvCmd, ok := Commands[strings.ToUpper(cmd.Command)]
+		// Unknown commands are reported as such whether or not the client has
+		// logged in.
 		if !ok {
-			// Send command unrecognized
 			client.sendReply(500, "Unknown command.")
 			continue
 		}
 
+		if client.state != stateLoggedIn && !srvCmd.preLogin {
+			client.sendReply(530, "You aren't logged in.")
+			continue
+		}
+
 		// Verify correct arity.
 		if len(cmd.Params) < srvCmd.argc {
 			client.sendReply(501, "Wrong number of arguments.")
 			continue
 		}
 
+		// Validate the argument against the command's grammar.
+		if srvCmd.parse != nil {
+			cmd.Value, err = srvCmd.parse(cmd.Arg)
+			if err == ErrUnsupportedParam {
+				client.sendReply(504, "Command not implemented for that parameter.")
+				continue
+			} else if err != nil {
+				client.sendReply(501, "Syntax error in parameters: %v", err)
+				continue
+			}
+		}
+
+		// A pending rename, restart or range is only completed by the command
+		// immediately following RNFR, REST or RANG. Urgent commands act on the running transfer, and
+		// leave the session alone.
+		if !srvCmd.urgent {
+			if upperCmd != "RNTO" {
+				client.renameFrom = ""
+			}
+			if upperCmd != "SITE" {
+				client.copyFrom = ""
+			}
+			if !srvCmd.keepsRestart {
+				client.restOffset = 0
+			}
+			if upperCmd != "HASH" {
+				client.hashRange = nil
+			}
+		}
+
+		if srvCmd.transfer {
+			client.startTransfer(srvCmd.handler, cmd)
+			continue
+		}
+
 		isExiting := srvCmd.handler(client, cmd)
 		if isExiting {
 			break
@@ -70,20 +148,70 @@ func (client *Client) handleConn() {
 }
 
 func (client *Client) sendReply(code int, format string, args ...interface{}) error {
+	client.replyMu.Lock()
+	defer client.replyMu.Unlock()
+
 	client.response.Reset()
-	formatted := fmt.Sprintf(format, args...)
+	formatted := client.encodeText(fmt.Sprintf(format, args...))
 	lines := strings.Split(formatted, "\n")
 
 	var i int
 	for i = 0; i < len(lines)-1; i++ {
 		_, _ = fmt.Fprintf(client.response, "%d-%s", code, lines[i])
+		client.bufferCrlf()
 	}
 	_, _ = fmt.Fprintf(client.response, "%d %s", code, lines[i])
+	client.bufferCrlf()
+
+	_, err := client.ctrlConn.Write(client.response.Bytes())
+	return err
+}
+
+// sendMultilineReply sends a reply spanning several lines. The first and last
+// lines carry the reply code, and the lines in between are indented by a single
+// space, as required by FEAT and conventional for other replies.
+func (client *Client) sendMultilineReply(code int, first string, lines []string, last string) error {
+	client.replyMu.Lock()
+	defer client.replyMu.Unlock()
+
+	client.response.Reset()
+	_, _ = fmt.Fprintf(client.response, "%d-%s", code, client.encodeText(first))
+	client.bufferCrlf()
+	for _, line := range lines {
+		client.response.WriteByte(' ')
+		client.response.WriteString(client.encodeText(line))
+		client.bufferCrlf()
+	}
+	_, _ = fmt.Fprintf(client.response, "%d %s", code, client.encodeText(last))
+	client.bufferCrlf()
 
 	_, err := client.ctrlConn.Write(client.response.Bytes())
 	return err
 }
 
+// Reply sends a reply with the given code to the client. Text spanning several
+// lines is sent as a multi-line reply.
+func (client *Client) Reply(code int, format string, args ...interface{}) error {
+	return client.sendReply(code, format, args...)
+}
+
+// User returns the name of the logged in user.
+func (client *Client) User() string {
+	return client.username
+}
+
+// RealPath returns the path on the host of the virtual path p, which is
+// relative to the client's working directory unless absolute.
+func (client *Client) RealPath(p string) (string, error) {
+	return client.realPath(p)
+}
+
+// WritablePath is like RealPath, but fails if p can't be modified by the
+// client.
+func (client *Client) WritablePath(p string) (string, error) {
+	return client.writablePath(p)
+}
+
 func (client *Client) bufferPadding() {
 	client.response.WriteByte(byte(' '))
 	client.response.WriteByte(byte(' '))
@@ -95,36 +223,253 @@ func (client *Client) bufferCrlf() {
 }
 
 func (client *Client) verifyDir(dir string) error {
-	realDir := filepath.Join(client.rootDir, dir)
+	if client.mounts.isVirtualDir(dir) {
+		return nil
+	}
+
+	realDir, err := client.realPath(dir)
+	if err != nil {
+		return pathErr(err)
+	}
 	return verifyDir(realDir)
 }
 
-func (client *Client) realPath(path string) string {
-	// If the new directory's path is relative, join it with the current working directory. If it's
-	// absolute, then use it directly.
-	var relDir string
-	paramDir := path
-	if filepath.IsAbs(paramDir) {
-		relDir = paramDir
-	} else {
-		relDir = filepath.Join(client.workingDir, paramDir)
+// virtualPath returns the clean, absolute virtual path corresponding to p. If p
+// is relative, it is interpreted relative to the current working directory.
+func (client *Client) virtualPath(p string) string {
+	if !path.IsAbs(p) {
+		p = path.Join(client.workingDir, p)
+	}
+	return path.Clean(p)
+}
+
+// realPath resolves p to a real path through the client's mount table.
+func (client *Client) realPath(p string) (string, error) {
+	vpath := client.virtualPath(p)
+	m, rest := client.mounts.lookup(vpath)
+	if m == nil {
+		if client.mounts.isVirtualDir(vpath) {
+			return "", syscall.EISDIR
+		}
+		return "", os.ErrNotExist
+	}
+
+	return client.resolver(m).resolve(rest)
+}
+
+// writablePath is like realPath, but fails if the path can't be modified,
+// either because it lies on a read-only mount or because it is a mount point.
+func (client *Client) writablePath(p string) (string, error) {
+	m, rest, err := client.writableMount(p)
+	if err != nil {
+		return "", err
+	}
+	return client.resolver(m).resolve(rest)
+}
+
+// writableLinkPath is like writablePath, but doesn't follow the last component
+// of the path if it is a symbolic link, for commands acting on directory
+// entries themselves, such as deleting or renaming them.
+func (client *Client) writableLinkPath(p string) (string, error) {
+	m, rest, err := client.writableMount(p)
+	if err != nil {
+		return "", err
+	}
+	return client.resolver(m).resolveLink(rest)
+}
+
+// writableMount returns the mount holding p, along with the rest of the path
+// below the mount point, if p can be modified.
+func (client *Client) writableMount(p string) (*mount, string, error) {
+	vpath := client.virtualPath(p)
+	m, rest := client.mounts.lookup(vpath)
+	if m == nil || m.readOnly {
+		return nil, "", ErrReadOnly
+	}
+	if rest == "/" {
+		return nil, "", ErrMountPoint
+	}
+	return m, rest, nil
+}
+
+func (client *Client) resolver(m *mount) resolver {
+	return resolver{
+		root:          m.source,
+		allowSymlinks: client.server.config.AllowSymlinks,
+	}
+}
+
+// rootOf returns the source of the mount holding the real path p, or "" if p
+// lies outside every mount, as the trash does.
+func (client *Client) rootOf(p string) string {
+	var root string
+	for _, m := range client.mounts {
+		if len(m.source) > len(root) && within(p, m.source) {
+			root = m.source
+		}
+	}
+	return root
+}
+
+// openReal opens the real path p like os.OpenFile, refusing to follow symbolic
+// links swapped into the path after it was resolved.
+func (client *Client) openReal(p string, flag int, perm os.FileMode) (*os.File, error) {
+	return openBeneath(client.rootOf(p), p, flag, perm)
+}
+
+// mkdirAllReal creates the directory p along with any missing parents like
+// os.MkdirAll, refusing to follow symbolic links like openReal.
+func (client *Client) mkdirAllReal(p string, perm os.FileMode) error {
+	root := client.rootOf(p)
+	if root == "" {
+		return os.MkdirAll(p, perm)
+	}
+
+	rel, err := relBeneath(root, p)
+	if err != nil {
+		return err
+	}
+
+	dir := root
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		if name == "." {
+			continue
+		}
+		dir = filepath.Join(dir, name)
+		if err := mkdirBeneath(root, dir, perm); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+
+	f, err := openBeneath(root, p, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if stat, err := f.Stat(); err != nil {
+		return err
+	} else if !stat.IsDir() {
+		return ErrNotDir
+	}
+	return nil
+}
+
+// chmodReal changes the mode of the real path p like os.Chmod, refusing to
+// follow symbolic links like openReal.
+func (client *Client) chmodReal(p string, mode os.FileMode) error {
+	return chmodBeneath(client.rootOf(p), p, mode)
+}
+
+// chtimesReal changes the access and modification times of the real path p
+// like os.Chtimes, refusing to follow symbolic links like openReal.
+func (client *Client) chtimesReal(p string, atime, mtime time.Time) error {
+	return chtimesBeneath(client.rootOf(p), p, atime, mtime)
+}
+
+// listDir returns the entries to list for the virtual path vpath. If vpath
+// names a file rather than a directory, the listing consists of the file alone.
+func (client *Client) listDir(vpath string) ([]os.FileInfo, error) {
+	if !client.mounts.isVirtualDir(vpath) {
+		realPath, err := client.realPath(vpath)
+		if err != nil {
+			return nil, pathErr(err)
+		}
+
+		stat, err := os.Stat(realPath)
+		if err != nil {
+			return nil, pathErr(err)
+		}
+		if !stat.IsDir() {
+			return []os.FileInfo{stat}, nil
+		}
+	}
+
+	return client.readDir(vpath)
+}
+
+// readDir returns the entries of the virtual directory vpath, sorted by name.
+// Mount points beneath vpath are merged into the listing, hiding any real
+// entries of the same name.
+func (client *Client) readDir(vpath string) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+	if m, rest := client.mounts.lookup(vpath); m != nil {
+		realDir, err := client.resolver(m).resolve(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		infos, err = ioutil.ReadDir(realDir)
+		if err != nil {
+			return nil, pathErr(err)
+		}
+	} else if !client.mounts.isVirtualDir(vpath) {
+		return nil, os.ErrNotExist
+	}
+
+	names := client.mounts.children(vpath)
+	if len(names) == 0 {
+		return infos, nil
+	}
+
+	byName := make(map[string]int, len(infos))
+	for i, fi := range infos {
+		byName[fi.Name()] = i
+	}
+
+	now := time.Now()
+	for _, name := range names {
+		var fi os.FileInfo = virtualDirInfo{name: name, modTime: now}
+		if m, rest := client.mounts.lookup(path.Join(vpath, name)); m != nil && rest == "/" {
+			if stat, err := os.Stat(m.source); err == nil {
+				fi = renamedInfo{FileInfo: stat, name: name}
+			}
+		}
+
+		if i, ok := byName[name]; ok {
+			infos[i] = fi
+		} else {
+			infos = append(infos, fi)
+		}
 	}
 
-	// Get the real directory by joining with the client's root directory.
-	return filepath.Join(client.rootDir, relDir)
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
 }
 
+// ensureDataConn opens the data connection for the running transfer, replying
+// with an error if it can't be opened.
 func (client *Client) ensureDataConn() bool {
-	// If we aren't in passive mode and don't have a data connection listener, abort.
+	t := client.currentTransfer()
 	var err error
+
+	// In active mode, connect to the address given by PORT.
+	if client.activeAddr != nil {
+		client.dataConn, err = t.dial(client.activeAddr)
+		if err == errTransferAborted {
+			_ = client.sendReply(426, "Transfer aborted")
+			return false
+		} else if err != nil {
+			_ = client.sendReply(425, "Can't open data connection")
+			return false
+		}
+		return true
+	}
+
+	// If we aren't in passive mode and don't have a data connection listener, abort.
 	if client.dataLis == nil {
 		_ = client.sendReply(425, "No data connection")
 		return false
 	}
 
-	// Block until we get a data connection.
-	client.dataConn, err = client.dataLis.Accept()
-	if err != nil {
+	// Block until we get a data connection, or the transfer is aborted.
+	client.dataConn, err = t.accept(client.dataLis)
+	if err == errTransferAborted {
+		_ = client.sendReply(426, "Transfer aborted")
+		return false
+	} else if err != nil {
 		_ = client.sendReply(421, "The connection couldn't be accepted")
 		return false
 	}
@@ -132,26 +477,344 @@ func (client *Client) ensureDataConn() bool {
 	return true
 }
 
-func (client *Client) writeFile(filename string, r io.Reader, perm os.FileMode, append bool) error {
+// closeDataListener gives up the client's passive mode port, if any.
+func (client *Client) closeDataListener() {
+	if client.dataPort != 0 {
+		client.server.releaseDataPort(client.dataPort)
+	}
+	client.dataPort = 0
+	client.dataLis = nil
+}
+
+// writeFile stores the contents of r in filename. If append is true, the
+// contents are appended to the file. Otherwise, the file is truncated to offset
+// bytes and the contents are written from there on.
+//
+// If atomic uploads are enabled, a new file is written under a hidden
+// temporary name in the same directory and renamed into place only once r has
+// been read completely, so that a half-written file is never visible under its
+// final name.
+//
+// If versioning is enabled, a file that is replaced is kept as a previous
+// version.
+func (client *Client) writeFile(filename string, r io.Reader, perm os.FileMode, append bool, offset int64) error {
+	return client.storeFile(filename, r, perm, append, offset, true)
+}
+
+// writeNewFile is like writeFile, but for a file the session has just created
+// empty to reserve its name, which isn't worth keeping as a previous version.
+func (client *Client) writeNewFile(filename string, r io.Reader, perm os.FileMode) error {
+	return client.storeFile(filename, r, perm, false, 0, false)
+}
+
+func (client *Client) storeFile(filename string, r io.Reader, perm os.FileMode, append bool, offset int64, version bool) error {
+	// In ASCII mode, translate the network's CRLF line endings as they arrive.
+	if client.translateASCII() {
+		pr, pw := io.Pipe()
+		go func(src io.Reader) {
+			_ = pw.CloseWithError(storeASCII(pw, src))
+		}(r)
+		defer pr.Close()
+		r = pr
+	}
+
+	config := client.server.config
+	if !config.AtomicUploads || append {
+		// A resumed upload continues the new version rather than replacing it.
+		if version && !append && offset == 0 {
+			if err := client.saveVersion(filename); err != nil {
+				return err
+			}
+		}
+		return client.writeFileAt(filename, r, perm, append, offset)
+	}
+
+	// The temporary name is opened without following links like any other
+	// path, but a link or directory planted there is refused up front.
+	tmp := partialName(filename)
+	if stat, err := os.Lstat(tmp); os.IsNotExist(err) {
+		if offset > 0 {
+			return ErrInvalidRestart
+		}
+	} else if err != nil {
+		return err
+	} else if !stat.Mode().IsRegular() {
+		return ErrNotPlainFile
+	}
+
+	if err := client.writeFileAt(tmp, r, perm, false, offset); err != nil {
+		// Keep what we have so that the upload can be resumed with REST.
+		if !config.KeepPartialUploads {
+			_ = client.removeFile(tmp)
+		}
+		return err
+	}
+
+	if version {
+		if err := client.saveVersion(filename); err != nil {
+			return err
+		}
+	}
+	return client.renameFile(tmp, filename)
+}
+
+func (client *Client) writeFileAt(filename string, r io.Reader, perm os.FileMode, append bool, offset int64) error {
 	flags := os.O_CREATE | os.O_WRONLY
 	if append {
 		flags |= os.O_APPEND
+	} else if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+
+	// Charge a new file against the quota up front, and credit back the contents
+	// of a file that is about to be truncated.
+	quotas := client.quotasFor(filename)
+	var truncated int64
+	stat, err := os.Lstat(filename)
+	if os.IsNotExist(err) {
+		if offset > 0 {
+			return ErrInvalidRestart
+		}
+		if err := quotas.reserve(0, 1); err != nil {
+			return err
+		}
+		stat = nil
+	} else if err == nil && !append && stat.Mode().IsRegular() {
+		// Restart offsets count bytes on the network, which differ from bytes on
+		// disk for ASCII transfers.
+		if offset > 0 && client.dataType == TypeASCII {
+			if offset, err = client.asciiFileOffset(filename, offset); err != nil {
+				return err
+			}
+		}
+		if offset > stat.Size() {
+			return ErrInvalidRestart
+		}
+		truncated = stat.Size() - offset
 	}
 
-	f, err := os.OpenFile(filename, flags, perm)
+	f, err := client.openReal(filename, flags, perm)
 	if err != nil {
+		if stat == nil {
+			quotas.release(0, 1)
+		}
 		return err
 	}
 	defer f.Close()
 
-	_, err = io.Copy(f, r)
+	// New files get the permissions given by the session's umask, rather than
+	// the process's.
+	if stat == nil {
+		if err := f.Chmod(perm); err != nil {
+			return err
+		}
+	}
+
+	if offset > 0 {
+		if err := f.Truncate(offset); err != nil {
+			return err
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	quotas.release(truncated, 0)
+
+	var w io.Writer = f
+	if len(quotas) > 0 {
+		w = &quotaWriter{w: f, quotas: quotas}
+	}
+
+	_, err = io.Copy(w, r)
 	return err
 }
 
+// asciiFileOffset maps the offset n in the ASCII translation of filename onto
+// an offset in filename itself.
+func (client *Client) asciiFileOffset(filename string, n int64) (int64, error) {
+	f, err := client.openReal(filename, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return asciiOffset(f, n)
+}
+
+// removeFile removes the file filename, crediting its size back to the quota.
+func (client *Client) removeFile(filename string) error {
+	stat, err := os.Lstat(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := removeBeneath(client.rootOf(filename), filename); err != nil {
+		return err
+	}
+
+	if stat.Mode().IsRegular() {
+		client.quotasFor(filename).release(stat.Size(), 1)
+	}
+	return nil
+}
+
+// renameFile renames oldpath to newpath, crediting the quota with the size of
+// any regular file that newpath replaces.
+func (client *Client) renameFile(oldpath, newpath string) error {
+	stat, err := os.Lstat(newpath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := renameBeneath(client.rootOf(oldpath), oldpath, client.rootOf(newpath), newpath); err != nil {
+		return err
+	}
+
+	if stat != nil && stat.Mode().IsRegular() {
+		client.quotasFor(newpath).release(stat.Size(), 1)
+	}
+	return nil
+}
+
+// moveFile renames oldpath, which may be a file or a directory, to newpath,
+// moving its usage between quotas if the two paths are covered by different
+// ones. Paths on different file systems are moved with moveAcross.
+func (client *Client) moveFile(oldpath, newpath string) error {
+	bytes, files, err := treeUsage(oldpath)
+	if err != nil {
+		return err
+	}
+
+	from, to := client.quotasFor(oldpath), client.quotasFor(newpath)
+	gained, lost := to.without(from), from.without(to)
+	if err := gained.reserve(bytes, files); err != nil {
+		return err
+	}
+
+	err = client.renameFile(oldpath, newpath)
+	if isCrossDevice(err) {
+		return client.moveAcross(oldpath, newpath, bytes, files, gained, lost)
+	}
+	if err != nil {
+		gained.release(bytes, files)
+		return err
+	}
+
+	lost.release(bytes, files)
+	return nil
+}
+
+// isCrossDevice reports whether err is a rename failing because its paths lie
+// on different file systems.
+func isCrossDevice(err error) bool {
+	le, ok := err.(*os.LinkError)
+	return ok && le.Err == syscall.EXDEV
+}
+
+// openFile opens the regular file at p for reading.
+func (client *Client) openFile(p string) (*os.File, os.FileInfo, error) {
+	realPath, err := client.realPath(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := client.openReal(realPath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	} else if !stat.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, ErrNotPlainFile
+	}
+
+	return f, stat, nil
+}
+
+// filePerm returns the permissions of files created by the session.
+func (client *Client) filePerm() os.FileMode {
+	return 0666 &^ client.umask
+}
+
+// dirPerm returns the permissions of directories created by the session.
+func (client *Client) dirPerm() os.FileMode {
+	return 0777 &^ client.umask
+}
+
+// maxUniqueAttempts is the number of names STOU, and moving files to the
+// trash, try before giving up.
+const maxUniqueAttempts = 10000
+
+// createUnique creates an empty file in the working directory, or relative to
+// it, with a name that doesn't exist yet: prefix itself, or prefix followed by
+// the first free numeric suffix. The file is created exclusively, so that
+// concurrent sessions never pick the same name.
+func (client *Client) createUnique(prefix string) (name, realPath string, err error) {
+	for i := 0; i < maxUniqueAttempts; i++ {
+		name = prefix
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", prefix, i)
+		}
+
+		realPath, err = client.writablePath(name)
+		if err != nil {
+			return "", "", err
+		}
+
+		quotas := client.quotasFor(realPath)
+		if err := quotas.reserve(0, 1); err != nil {
+			return "", "", err
+		}
+
+		f, err := client.openReal(realPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, client.filePerm())
+		if err == nil {
+			err = f.Chmod(client.filePerm())
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			return name, realPath, err
+		}
+
+		quotas.release(0, 1)
+		if !os.IsExist(err) {
+			return "", "", err
+		}
+	}
+
+	return "", "", os.ErrExist
+}
+
+// partialName returns the hidden name under which an atomic upload to filename
+// is written until it completes.
+func partialName(filename string) string {
+	dir, name := filepath.Split(filename)
+	return filepath.Join(dir, "."+name+".part")
+}
+
+// partialUpload returns the temporary file of an interrupted atomic upload to
+// filename, if one was kept.
+func (client *Client) partialUpload(filename string) (string, os.FileInfo, bool) {
+	config := client.server.config
+	if !config.AtomicUploads || !config.KeepPartialUploads {
+		return "", nil, false
+	}
+
+	tmp := partialName(filename)
+	stat, err := os.Lstat(tmp)
+	if err != nil || !stat.Mode().IsRegular() {
+		return "", nil, false
+	}
+	return tmp, stat, true
+}
+
 func verifyDir(dir string) error {
 	stat, err := os.Stat(dir)
 	if err != nil {
-		return err.(*os.PathError).Err
+		return pathErr(err)
 	}
 
 	if !stat.IsDir() {
@@ -160,3 +823,15 @@ func verifyDir(dir string) error {
 
 	return nil
 }
+
+// pathErr strips the operation and path from errors returned by the os
+// package, so that real paths aren't leaked to the client.
+func pathErr(err error) error {
+	switch v := err.(type) {
+	case *os.PathError:
+		return v.Err
+	case *os.LinkError:
+		return v.Err
+	}
+	return err
+}
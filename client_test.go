@@ -0,0 +1,278 @@
+package charter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"testing"
+
+	"github.com/maybetheresloop/charter-go/passwd"
+	"github.com/stretchr/testify/assert"
+)
+
+// testBackend is an authentication backend knowing a fixed set of users.
+type testBackend map[string]string
+
+func init() {
+	passwd.Register("test", testBackend{"alice": "secret", "bob": "secret"})
+}
+
+func (b testBackend) OpenConnector(dataSourceName string) (passwd.Connector, error) {
+	return b, nil
+}
+
+func (b testBackend) GetPassword(user string) (string, error) {
+	pass, ok := b[user]
+	if !ok {
+		return "", passwd.ErrNotExist
+	}
+	return pass, nil
+}
+
+func (b testBackend) CheckUserPassword(user string, pass string) error {
+	want, err := b.GetPassword(user)
+	if err != nil {
+		return err
+	} else if pass != want {
+		return passwd.ErrIncorrectPassword
+	}
+	return nil
+}
+
+func (b testBackend) Sync() error {
+	return nil
+}
+
+// testSession drives a client over an in-memory control connection.
+type testSession struct {
+	t    *testing.T
+	conn *textproto.Conn
+	srv  *Server
+	root string
+}
+
+// newTestSession starts a session against a fresh temporary directory and
+// logs in. The caller may adjust config before the session starts.
+func newTestSession(t *testing.T, configure func(config *Config)) (*testSession, func()) {
+	root, err := ioutil.TempDir("", "charter-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{DefaultDir: root, Backend: []BackendConf{{Name: "test"}}}
+	if configure != nil {
+		configure(config)
+	}
+
+	srv := NewServer(config)
+	srvConn, cliConn := net.Pipe()
+	client := srv.newClient(srvConn)
+	go client.handleConn()
+
+	s := &testSession{t: t, conn: textproto.NewConn(cliConn), srv: srv, root: root}
+	if _, _, err := s.conn.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	s.expect("USER alice", 331)
+	s.expect("PASS secret", 230)
+
+	return s, func() {
+		s.conn.Close()
+		os.RemoveAll(root)
+	}
+}
+
+// cmd sends line and returns the reply.
+func (s *testSession) cmd(line string) (int, string) {
+	if err := s.conn.PrintfLine("%s", line); err != nil {
+		s.t.Fatal(err)
+	}
+
+	code, msg, err := s.conn.ReadResponse(0)
+	if err != nil {
+		if _, ok := err.(*textproto.Error); !ok {
+			s.t.Fatal(err)
+		}
+	}
+	return code, msg
+}
+
+// expect sends line and asserts that the reply has the given code.
+func (s *testSession) expect(line string, code int) string {
+	got, msg := s.cmd(line)
+	assert.Equal(s.t, code, got, "%s: %s", line, msg)
+	return msg
+}
+
+func TestFeat(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	msg := s.expect("FEAT", 211)
+	assert.Contains(t, msg, "Extensions supported:")
+	assert.Contains(t, msg, " REST STREAM")
+
+	s.expect("OPTS BOGUS ON", 501)
+}
+
+func TestRename(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	assert.Nil(t, ioutil.WriteFile(s.root+"/a.txt", []byte("a"), 0644))
+	s.expect("MKD sub", 257)
+
+	s.expect("RNTO b.txt", 503)
+	s.expect("RNFR missing.txt", 550)
+
+	s.expect("RNFR a.txt", 350)
+	s.expect("NOOP", 200)
+	s.expect("RNTO b.txt", 503)
+
+	s.expect("RNFR a.txt", 350)
+	s.expect("RNTO sub/b.txt", 250)
+	_, err := os.Stat(s.root + "/sub/b.txt")
+	assert.Nil(t, err)
+}
+
+func TestRenameLinks(t *testing.T) {
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.AllowSymlinks = true
+	})
+	defer cleanup()
+
+	assert.Nil(t, os.MkdirAll(s.root+"/a/b", 0755))
+	assert.Nil(t, os.MkdirAll(s.root+"/c/d", 0755))
+	assert.Nil(t, ioutil.WriteFile(s.root+"/target.txt", []byte("target"), 0644))
+	s.expect("SITE SYMLINK target.txt a/b/link", 200)
+
+	// Moved up, the link would point above the root.
+	s.expect("RNFR a/b", 350)
+	s.expect("RNTO b", 550)
+	s.expect("RNFR a", 350)
+	s.expect("RNTO c/d/a", 250)
+	s.expect("RNFR c/d/a/b", 350)
+	s.expect("RNTO b", 550)
+	s.expect("RNFR c/d/a", 350)
+	s.expect("RNTO a", 250)
+
+	// At the same depth, it still points inside.
+	s.expect("RNFR a/b", 350)
+	s.expect("RNTO c/d", 250)
+	target, err := os.Readlink(s.root + "/c/d/link")
+	assert.Nil(t, err)
+	assert.Equal(t, "../../target.txt", target)
+}
+
+func TestDeleteAndRenameLinks(t *testing.T) {
+	for _, allow := range []bool{true, false} {
+		s, cleanup := newTestSession(t, func(config *Config) {
+			config.AllowSymlinks = allow
+		})
+
+		assert.Nil(t, os.MkdirAll(s.root+"/a/b", 0755))
+		assert.Nil(t, ioutil.WriteFile(s.root+"/t.txt", []byte("target"), 0644))
+		assert.Nil(t, os.Symlink("../../t.txt", s.root+"/a/b/link"))
+		assert.Nil(t, os.Symlink("b", s.root+"/a/dir"))
+
+		// Renaming and deleting act on the links, not their targets.
+		s.expect("RNFR a/b/link", 350)
+		s.expect("RNTO a/b/renamed", 250)
+		target, err := os.Readlink(s.root + "/a/b/renamed")
+		assert.Nil(t, err)
+		assert.Equal(t, "../../t.txt", target)
+
+		s.expect("RNFR a/b/renamed", 350)
+		s.expect("RNTO renamed", 550)
+
+		s.expect("RMD a/dir", 550)
+		s.expect("DELE a/dir", 250)
+		s.expect("DELE a/b/renamed", 250)
+		for _, name := range []string{"/a/dir", "/a/b/renamed"} {
+			_, err = os.Lstat(s.root + name)
+			assert.True(t, os.IsNotExist(err), name)
+		}
+		b, err := ioutil.ReadFile(s.root + "/t.txt")
+		assert.Nil(t, err)
+		assert.Equal(t, "target", string(b))
+		_, err = os.Stat(s.root + "/a/b")
+		assert.Nil(t, err)
+
+		cleanup()
+	}
+}
+
+// transfer sets up an active mode data connection with PORT, sends line and
+// waits for the transfer to complete. If data is nil, everything read from the
+// data connection is returned; otherwise, data is written to it.
+func (s *testSession) transfer(line string, data []byte) (int, []byte) {
+	started, code, b := s.tryTransfer(line, data)
+	if started {
+		assert.Equal(s.t, 226, code, line)
+	}
+	return code, b
+}
+
+// tryTransfer is like transfer, but returns the final reply of a transfer that
+// was started without expecting it to succeed.
+func (s *testSession) tryTransfer(line string, data []byte) (started bool, code int, b []byte) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer lis.Close()
+
+	port := lis.Addr().(*net.TCPAddr).Port
+	s.expect(fmt.Sprintf("PORT 127,0,0,1,%d,%d", port>>8, port&0xFF), 200)
+
+	if err := s.conn.PrintfLine("%s", line); err != nil {
+		s.t.Fatal(err)
+	}
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+
+		if data != nil {
+			_, _ = conn.Write(data)
+			received <- nil
+			return
+		}
+		b, _ := ioutil.ReadAll(conn)
+		received <- b
+	}()
+
+	code, _, _ = s.conn.ReadResponse(0)
+	if code != 150 {
+		return false, code, nil
+	}
+
+	b = <-received
+	code, _, _ = s.conn.ReadResponse(0)
+	return true, code, b
+}
+
+func TestStou(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	code, _ := s.transfer("STOU scan.txt", []byte("first"))
+	assert.Equal(t, 226, code)
+	code, _ = s.transfer("STOU scan.txt", []byte("second"))
+	assert.Equal(t, 226, code)
+	code, _ = s.transfer("STOU", []byte("third"))
+	assert.Equal(t, 226, code)
+
+	for name, content := range map[string]string{"scan.txt": "first", "scan.txt.1": "second", "stou": "third"} {
+		b, err := ioutil.ReadFile(s.root + "/" + name)
+		assert.Nil(t, err)
+		assert.Equal(t, content, string(b))
+	}
+}
@@ -6,8 +6,10 @@ import (
 )
 
 var (
-	ErrLineIsEmpty = errors.New("line is empty")
-	ErrNotDir      = errors.New("not a directory")
+	ErrLineIsEmpty    = errors.New("line is empty")
+	ErrNotDir         = errors.New("not a directory")
+	ErrNotPlainFile   = errors.New("not a plain file")
+	ErrInvalidRestart = errors.New("invalid restart offset")
 )
 
 type commandHandler func(client *Client, command FtpCommand) (isExiting bool)
@@ -15,6 +17,44 @@ type commandHandler func(client *Client, command FtpCommand) (isExiting bool)
 type Command struct {
 	argc    int
 	handler commandHandler
+
+	// parse, if set, validates the command's argument before the handler runs.
+	parse argParser
+
+	// feature returns the line advertising the command's extension in response
+	// to FEAT, or an empty string if the extension isn't available to the client.
+	feature func(client *Client) string
+
+	// opts handles OPTS for the command. Its parameters are those following the
+	// command name.
+	opts commandHandler
+
+	// transfer is set for commands that transfer data. Their handlers run in the
+	// background, so that the control connection is still read meanwhile.
+	transfer bool
+
+	// preLogin is set for commands that are accepted before the client has
+	// logged in.
+	preLogin bool
+
+	// keepsRestart is set for commands after which a pending REST still applies:
+	// the transfers that make use of it, and those setting up their data
+	// connection.
+	keepsRestart bool
+
+	// help is the usage of a SITE sub-command, shown by SITE HELP.
+	help string
+
+	// urgent is set for commands that are handled even while a transfer is in
+	// progress. Other commands wait for the transfer to finish.
+	urgent bool
+}
+
+// staticFeature returns a feature function that always advertises feat.
+func staticFeature(feat string) func(client *Client) string {
+	return func(client *Client) string {
+		return feat
+	}
 }
 
 var Commands map[string]Command
@@ -22,12 +62,14 @@ var Commands map[string]Command
 func init() {
 	Commands = map[string]Command{
 		"USER": {
-			argc:    1,
-			handler: userHandler,
+			argc:     1,
+			handler:  userHandler,
+			preLogin: true,
 		},
 		"PASS": {
-			argc:    1,
-			handler: passHandler,
+			argc:     1,
+			handler:  passHandler,
+			preLogin: true,
 		},
 		"ACCT": {
 			argc:    1,
@@ -46,52 +88,83 @@ func init() {
 			handler: notImplementedHandler,
 		},
 		"QUIT": {
-			argc:    0,
-			handler: quitHandler,
+			argc:     0,
+			handler:  quitHandler,
+			preLogin: true,
 		},
 		"REIN": {
-			argc:    0,
-			handler: notImplementedHandler,
+			argc:     0,
+			handler:  reinHandler,
+			preLogin: true,
 		},
 		"PORT": {
-			argc:    1,
-			handler: notImplementedHandler,
+			argc:         1,
+			handler:      portHandler,
+			parse:        parseHostPort,
+			keepsRestart: true,
 		},
 		"PASV": {
-			argc:    0,
-			handler: pasvHandler,
+			argc:         0,
+			handler:      pasvHandler,
+			keepsRestart: true,
 		},
 		"TYPE": {
 			argc:    1,
-			handler: notImplementedHandler,
+			handler: typeHandler,
+			parse:   parseType,
 		},
 		"STRU": {
 			argc:    1,
-			handler: notImplementedHandler,
+			handler: struHandler,
+			parse:   parseStru,
 		},
 		"MODE": {
 			argc:    1,
 			handler: modeHandler,
+			parse:   parseMode,
+			feature: modeZFeature,
+			opts:    modeOptsHandler,
 		},
 		"RETR": {
+			argc:         1,
+			handler:      retrHandler,
+			transfer:     true,
+			keepsRestart: true,
+		},
+		"REST": {
 			argc:    1,
-			handler: notImplementedHandler,
+			handler: restHandler,
+			parse:   parseOffset,
+			feature: staticFeature("REST STREAM"),
 		},
 		"STOR": {
-			argc:    1,
-			handler: storHandler,
+			argc:         1,
+			handler:      storHandler,
+			transfer:     true,
+			keepsRestart: true,
 		},
 		"STOU": {
-			argc:    0,
-			handler: notImplementedHandler,
+			argc:     0,
+			handler:  stouHandler,
+			transfer: true,
 		},
 		"APPE": {
+			argc:     1,
+			handler:  appeHandler,
+			transfer: true,
+		},
+		"RNFR": {
+			argc:    1,
+			handler: rnfrHandler,
+		},
+		"RNTO": {
 			argc:    1,
-			handler: appeHandler,
+			handler: rntoHandler,
 		},
 		"ABOR": {
 			argc:    0,
-			handler: notImplementedHandler,
+			handler: aborHandler,
+			urgent:  true,
 		},
 		"DELE": {
 			argc:    1,
@@ -110,34 +183,149 @@ func init() {
 			handler: pwdHandler,
 		},
 		"LIST": {
-			argc:    0,
-			handler: listHandler,
+			argc:     0,
+			handler:  listHandler,
+			transfer: true,
 		},
 		"NLST": {
-			argc:    0,
-			handler: nlstHandler,
+			argc:     0,
+			handler:  nlstHandler,
+			transfer: true,
 		},
 		"NOOP": {
+			argc:     0,
+			handler:  noopHandler,
+			preLogin: true,
+		},
+		"SIZE": {
+			argc:    1,
+			handler: sizeHandler,
+			feature: staticFeature("SIZE"),
+		},
+		"FEAT": {
+			argc:     0,
+			handler:  featHandler,
+			preLogin: true,
+		},
+		"OPTS": {
+			argc:     1,
+			handler:  optsHandler,
+			preLogin: true,
+		},
+		"LANG": {
+			argc:     0,
+			handler:  langHandler,
+			feature:  langFeature,
+			preLogin: true,
+		},
+		"HASH": {
+			argc:    1,
+			handler: hashHandler,
+			feature: hashFeature,
+			opts:    hashOptsHandler,
+		},
+		"RANG": {
+			argc:    2,
+			handler: rangHandler,
+			parse:   parseRange,
+			feature: staticFeature("RANG STREAM"),
+		},
+		"XCRC": {
+			argc:    1,
+			handler: legacyHashHandler("CRC32"),
+			parse:   parseHashArg,
+		},
+		"XMD5": {
+			argc:    1,
+			handler: legacyHashHandler("MD5"),
+			parse:   parseHashArg,
+		},
+		"XSHA1": {
+			argc:    1,
+			handler: legacyHashHandler("SHA-1"),
+			parse:   parseHashArg,
+		},
+		"XSHA256": {
+			argc:    1,
+			handler: legacyHashHandler("SHA-256"),
+			parse:   parseHashArg,
+		},
+		"MFMT": {
+			argc:    2,
+			handler: mfmtHandler,
+			parse:   parseTimeArg,
+			feature: staticFeature("MFMT"),
+		},
+		"MFCT": {
+			argc:    2,
+			handler: mfctHandler,
+			parse:   parseTimeArg,
+		},
+		"MFF": {
+			argc:    2,
+			handler: mffHandler,
+			parse:   parseMff,
+			feature: mffFeature,
+		},
+		"RMDA": {
+			argc:    1,
+			handler: rmdaHandler,
+		},
+		"STAT": {
 			argc:    0,
-			handler: noopHandler,
+			handler: statHandler,
+			urgent:  true,
+		},
+		"SITE": {
+			argc:    1,
+			handler: siteHandler,
 		},
 	}
 }
 
+// extensions holds extensions that aren't tied to a command of their own but
+// are still advertised by FEAT and configured through OPTS, keyed by name.
+var extensions = map[string]Command{
+	"UTF8": {
+		feature: utf8Feature,
+		opts:    utf8OptsHandler,
+	},
+}
+
+// FtpCommand is a command received on the control connection.
 type FtpCommand struct {
+	// Command is the command's verb, as sent by the client.
 	Command string
-	Params  []string
+
+	// Arg is the raw argument following the verb and the single space
+	// separating them. It may itself contain spaces, e.g. in pathnames.
+	Arg string
+
+	// Params holds the space-separated fields of Arg, for commands taking
+	// several parameters.
+	Params []string
+
+	// Value holds Arg as parsed by the command's argument parser, if any.
+	Value interface{}
 }
 
-// ParseLine parses an FTP command from the given FTP line.
+// ParseLine parses an FTP command from the given FTP line. As in RFC 959, the
+// verb is separated from the argument by a single space; the rest of the line
+// is the argument, verbatim.
 func ParseLine(line string) (FtpCommand, error) {
-	arr := strings.Fields(line)
-	if len(arr) == 0 {
+	line = strings.TrimLeft(line, " ")
+	if line == "" {
 		return FtpCommand{}, ErrLineIsEmpty
 	}
 
+	verb, arg := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		verb, arg = line[:i], line[i+1:]
+	}
+
 	return FtpCommand{
-		Command: arr[0],
-		Params:  arr[1:],
+		Command: verb,
+		Arg:     arg,
+		Params:  strings.Fields(arg),
 	}, nil
 }
@@ -0,0 +1,113 @@
+package charter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line string
+		cmd  FtpCommand
+	}{
+		{line: "NOOP", cmd: FtpCommand{Command: "NOOP"}},
+		{line: "STOR my report.pdf", cmd: FtpCommand{Command: "STOR", Arg: "my report.pdf", Params: []string{"my", "report.pdf"}}},
+		{line: "CWD  leading space", cmd: FtpCommand{Command: "CWD", Arg: " leading space", Params: []string{"leading", "space"}}},
+		{line: "MKD trailing ", cmd: FtpCommand{Command: "MKD", Arg: "trailing ", Params: []string{"trailing"}}},
+	}
+
+	for _, tt := range tests {
+		cmd, err := ParseLine(tt.line)
+		assert.Nil(t, err, tt.line)
+		if len(tt.cmd.Params) == 0 {
+			tt.cmd.Params = []string{}
+		}
+		assert.Equal(t, tt.cmd, cmd, tt.line)
+	}
+
+	_, err := ParseLine("   ")
+	assert.Equal(t, ErrLineIsEmpty, err)
+}
+
+func TestParseType(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want interface{}
+		err  error
+	}{
+		{arg: "A", want: typeArg{dataType: TypeASCII, format: 'N'}},
+		{arg: "a n", want: typeArg{dataType: TypeASCII, format: 'N'}},
+		{arg: "I", want: typeArg{dataType: TypeImage}},
+		{arg: "L 8", want: typeArg{dataType: TypeImage}},
+		{arg: "A T", err: ErrUnsupportedParam},
+		{arg: "L 36", err: ErrUnsupportedParam},
+		{arg: "E", err: ErrUnsupportedParam},
+	}
+
+	for _, tt := range tests {
+		got, err := parseType(tt.arg)
+		assert.Equal(t, tt.err, err, tt.arg)
+		assert.Equal(t, tt.want, got, tt.arg)
+	}
+
+	for _, arg := range []string{"", "X", "A X", "I 8", "L", "L x"} {
+		_, err := parseType(arg)
+		assert.NotNil(t, err, arg)
+		assert.NotEqual(t, ErrUnsupportedParam, err, arg)
+	}
+}
+
+func TestParseHostPort(t *testing.T) {
+	addr, err := parseHostPort("127,0,0,1,156,65")
+	assert.Nil(t, err)
+	assert.True(t, net.IPv4(127, 0, 0, 1).Equal(addr.(*net.TCPAddr).IP))
+	assert.Equal(t, 40001, addr.(*net.TCPAddr).Port)
+
+	for _, arg := range []string{"", "127,0,0,1,156", "127,0,0,1,156,256", "a,b,c,d,e,f"} {
+		_, err := parseHostPort(arg)
+		assert.NotNil(t, err, arg)
+	}
+}
+
+func TestParseOffset(t *testing.T) {
+	offset, err := parseOffset("1024")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1024), offset)
+
+	for _, arg := range []string{"", "-1", "1k"} {
+		_, err := parseOffset(arg)
+		assert.NotNil(t, err, arg)
+	}
+}
+
+func TestSplitListArg(t *testing.T) {
+	tests := []struct {
+		arg      string
+		opts     string
+		pathname string
+	}{
+		{arg: "", opts: "", pathname: ""},
+		{arg: "-la", opts: "la", pathname: ""},
+		{arg: "-l -a Q1 Results", opts: "la", pathname: "Q1 Results"},
+		{arg: "Q1 Results", opts: "", pathname: "Q1 Results"},
+	}
+
+	for _, tt := range tests {
+		opts, pathname := splitListArg(tt.arg)
+		assert.Equal(t, tt.opts, opts, tt.arg)
+		assert.Equal(t, tt.pathname, pathname, tt.arg)
+	}
+}
+
+func TestPathnamesWithSpaces(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	s.expect("MKD Q1 Results", 257)
+	s.expect("CWD Q1 Results", 250)
+	s.expect("MODE X", 501)
+	s.expect("MODE C", 504)
+	s.expect("REST abc", 501)
+}
@@ -0,0 +1,301 @@
+package charter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+var ErrCopyIntoSelf = errors.New("can't copy a directory into itself")
+
+// contextReader fails reads once its context is done, so that long copies can
+// be cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if cr.ctx.Err() != nil {
+		return 0, errTransferAborted
+	}
+	return cr.r.Read(p)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+// copyFile copies the regular file src, described by fi, to the new file dst,
+// charging it to dst's quotas.
+func (client *Client) copyFile(src, dst string, fi os.FileInfo, t *transfer) error {
+	quotas := client.quotasFor(dst)
+	if err := quotas.reserve(fi.Size(), 1); err != nil {
+		return err
+	}
+
+	err := client.copyFileData(src, dst, fi.Mode().Perm(), t)
+	if err != nil {
+		quotas.release(fi.Size(), 1)
+	}
+	return err
+}
+
+func (client *Client) copyFileData(src, dst string, perm os.FileMode, t *transfer) error {
+	in, err := client.openReal(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := client.openReal(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(countingWriter{w: out, n: &t.bytes}, contextReader{ctx: t.ctx, r: in})
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = removeBeneath(client.rootOf(dst), dst)
+	}
+	return err
+}
+
+// copyTree copies the directory src to dst, which mustn't exist yet. Symbolic
+// links and special files are skipped, so the copy never reaches outside the
+// tree.
+func (client *Client) copyTree(src, dst string, t *transfer) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if t.ctx.Err() != nil {
+			return errTransferAborted
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			return mkdirBeneath(client.rootOf(target), target, fi.Mode().Perm())
+		case fi.Mode().IsRegular():
+			return client.copyFile(p, target, fi, t)
+		}
+		return nil
+	})
+}
+
+func siteCpfrHandler(client *Client, command FtpCommand) (isExiting bool) {
+	paramPath := command.Arg
+	realPath, err := client.realPath(paramPath)
+	if err != nil {
+		_ = client.sendReply(550, "Can't copy %s: %v", paramPath, err)
+		return
+	}
+
+	if _, err := os.Stat(realPath); err != nil {
+		_ = client.sendReply(550, "Can't copy %s: %v", paramPath, pathErr(err))
+		return
+	}
+
+	client.copyFrom = client.virtualPath(paramPath)
+	_ = client.sendReply(350, "File or directory exists, ready for destination name")
+	return
+}
+
+// siteCptoHandler handles SITE CPTO, copying the file or directory given to
+// SITE CPFR. It runs as a transfer, so it can be aborted with ABOR, in which
+// case the partial copy is removed.
+func siteCptoHandler(client *Client, command FtpCommand) (isExiting bool) {
+	start := time.Now()
+	t := client.currentTransfer()
+	fromPath := client.copyFrom
+	client.copyFrom = ""
+	if fromPath == "" {
+		_ = client.sendReply(503, "Need SITE CPFR before SITE CPTO")
+		return
+	}
+
+	// Resolve the source again, in case the tree changed since SITE CPFR.
+	realFrom, err := client.realPath(fromPath)
+	if err != nil {
+		_ = client.sendReply(550, "Can't copy %s: %v", fromPath, err)
+		return
+	}
+	stat, err := os.Stat(realFrom)
+	if err != nil {
+		_ = client.sendReply(550, "Can't copy %s: %v", fromPath, pathErr(err))
+		return
+	}
+
+	paramPath := command.Arg
+	realTo, err := client.writablePath(paramPath)
+	if err != nil {
+		_ = client.sendReply(553, "Can't copy to %s: %v", paramPath, err)
+		return
+	}
+	if _, err := os.Lstat(realTo); !os.IsNotExist(err) {
+		_ = client.sendReply(553, "Can't copy to %s: %v", paramPath, os.ErrExist)
+		return
+	}
+
+	if stat.IsDir() {
+		if rel, err := filepath.Rel(realFrom, realTo); err == nil && !escapesRoot(rel) {
+			_ = client.sendReply(553, "Can't copy to %s: %v", paramPath, ErrCopyIntoSelf)
+			return
+		}
+		err = client.copyTree(realFrom, realTo, t)
+	} else if stat.Mode().IsRegular() {
+		err = client.copyFile(realFrom, realTo, stat, t)
+	} else {
+		err = ErrNotPlainFile
+	}
+
+	if err != nil {
+		if stat.IsDir() {
+			client.removeTree(realTo, client.virtualPath(paramPath))
+		}
+
+		if t.isAborted() {
+			_ = client.sendReply(426, "Copy aborted")
+		} else if err == ErrQuotaExceeded {
+			_ = client.sendReply(552, "Can't copy to %s: Exceeded storage allocation", paramPath)
+		} else {
+			_ = client.sendReply(550, "Can't copy to %s: %v", paramPath, pathErr(err))
+		}
+		return
+	}
+
+	_ = client.sendReply(250, "Copy successful")
+	event := client.newEvent(EventCopy, client.virtualPath(paramPath), realTo, atomic.LoadInt64(&t.bytes), start)
+	event.OldPath = fromPath
+	client.server.hooks.dispatch(event)
+	return
+}
+
+// moveAcross moves oldpath to newpath by copying it and then removing the
+// original, for when the two lie on different file systems and can't simply
+// be renamed. The copy is made under a hidden name and renamed into place once
+// complete, so that newpath is only ever replaced by a whole copy. bytes and
+// files have been reserved from gained; whatever is removed from oldpath is
+// credited back to lost.
+func (client *Client) moveAcross(oldpath, newpath string, bytes, files int64, gained, lost quotaSet) error {
+	dir, name := filepath.Split(newpath)
+	tmp := filepath.Join(dir, "."+name+".move")
+	if err := client.copyAll(oldpath, tmp); err != nil {
+		_ = client.removeAll(tmp, nil)
+		gained.release(bytes, files)
+		return err
+	}
+
+	if err := client.renameFile(tmp, newpath); err != nil {
+		_ = client.removeAll(tmp, nil)
+		gained.release(bytes, files)
+		return err
+	}
+
+	return client.removeAll(oldpath, lost)
+}
+
+// copyAll copies the file, symbolic link or directory tree src to dst, which
+// mustn't exist yet, keeping permissions and modification times. Links are
+// copied rather than followed. Unlike copyTree, nothing is charged to a quota,
+// and special files can't be copied.
+func (client *Client) copyAll(src, dst string) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case fi.IsDir():
+			return mkdirBeneath(client.rootOf(target), target, fi.Mode().Perm())
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return symlinkBeneath(client.rootOf(target), link, target)
+		case fi.Mode().IsRegular():
+			if err := client.copyData(p, target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+			return client.chtimesReal(target, time.Time{}, fi.ModTime())
+		}
+		return &os.PathError{Op: "copy", Path: p, Err: ErrNotPlainFile}
+	})
+}
+
+func (client *Client) copyData(src, dst string, perm os.FileMode) error {
+	in, err := client.openReal(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := client.openReal(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// removeAll removes p and, if it is a directory, everything in it, without
+// following symbolic links. The size of each regular file removed is credited
+// to quotas. Unlike removeTree, removeAll stops at the first failure.
+func (client *Client) removeAll(p string, quotas quotaSet) error {
+	var entries []string
+	var infos []os.FileInfo
+	err := filepath.Walk(p, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		entries = append(entries, p)
+		infos = append(infos, fi)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Walk visits directories before their contents, so removing in reverse
+	// order empties each directory before it is removed.
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := removeBeneath(client.rootOf(entries[i]), entries[i]); err != nil {
+			return err
+		}
+		if infos[i].Mode().IsRegular() {
+			quotas.release(infos[i].Size(), 1)
+		}
+	}
+	return nil
+}
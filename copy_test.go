@@ -0,0 +1,109 @@
+package charter
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSiteCopy(t *testing.T) {
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.Users = map[string]UserConf{"alice": {Quota: QuotaConf{Bytes: 20}}}
+	})
+	defer cleanup()
+
+	makeTree(t, s.root)
+
+	s.expect("SITE CPTO copy", 503)
+	s.expect("SITE CPFR missing", 550)
+
+	s.expect("SITE CPFR project/README", 350)
+	s.expect("SITE CPTO README.copy", 250)
+	b, err := ioutil.ReadFile(filepath.Join(s.root, "README.copy"))
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(b))
+
+	// A pending copy is forgotten by any other command.
+	s.expect("SITE CPFR project", 350)
+	s.expect("NOOP", 200)
+	s.expect("SITE CPTO template", 503)
+
+	s.expect("SITE CPFR project", 350)
+	s.expect("SITE CPTO project/src/copy", 553)
+	s.expect("SITE CPFR project", 350)
+	s.expect("SITE CPTO README.copy", 553)
+
+	s.expect("SITE CPFR project", 350)
+	s.expect("SITE CPTO template", 250)
+	b, err = ioutil.ReadFile(filepath.Join(s.root, "template/src/pkg/lib.go"))
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(b))
+
+	// A second copy doesn't fit in the quota, and is removed again.
+	s.expect("SITE CPFR project", 350)
+	s.expect("SITE CPTO template2", 552)
+	_, err = os.Stat(filepath.Join(s.root, "template2"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCopyTreeAborted(t *testing.T) {
+	root, cleanup := setupJail(t)
+	defer cleanup()
+	makeTree(t, root)
+
+	tr := &transfer{}
+	tr.ctx, tr.cancel = context.WithCancel(context.Background())
+	tr.cancel()
+
+	client := NewServer(&Config{DefaultDir: root}).newClient(nil)
+	err := client.copyTree(filepath.Join(root, "project"), filepath.Join(root, "copy"), tr)
+	assert.Equal(t, errTransferAborted, err)
+}
+
+func TestMoveAcross(t *testing.T) {
+	root, cleanup := setupJail(t)
+	defer cleanup()
+	makeTree(t, root)
+	assert.Nil(t, os.Symlink("README", filepath.Join(root, "project/link")))
+	mtime := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, os.Chtimes(filepath.Join(root, "project/README"), mtime, mtime))
+
+	client := NewServer(&Config{DefaultDir: root}).newClient(nil)
+	gained := &quota{limit: QuotaConf{Bytes: 100}, scanned: true}
+	lost := &quota{bytes: 12, files: 3, scanned: true}
+	assert.Nil(t, gained.reserve(12, 3))
+
+	// A failed copy leaves the source alone and releases the reservation.
+	err := client.moveAcross(filepath.Join(root, "project"), filepath.Join(root, "missing/moved"), 12, 3, quotaSet{gained}, quotaSet{lost})
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(0), gained.bytes)
+	_, err = os.Stat(filepath.Join(root, "project/src/pkg/lib.go"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, gained.reserve(12, 3))
+	err = client.moveAcross(filepath.Join(root, "project"), filepath.Join(root, "moved"), 12, 3, quotaSet{gained}, quotaSet{lost})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12), gained.bytes)
+	assert.Equal(t, int64(0), lost.bytes)
+	assert.Equal(t, int64(0), lost.files)
+
+	_, err = os.Lstat(filepath.Join(root, "project"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Lstat(filepath.Join(root, ".moved.move"))
+	assert.True(t, os.IsNotExist(err))
+
+	b, err := ioutil.ReadFile(filepath.Join(root, "moved/src/pkg/lib.go"))
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(b))
+	stat, err := os.Stat(filepath.Join(root, "moved/README"))
+	assert.Nil(t, err)
+	assert.True(t, stat.ModTime().Equal(mtime))
+	target, err := os.Readlink(filepath.Join(root, "moved/link"))
+	assert.Nil(t, err)
+	assert.Equal(t, "README", target)
+}
@@ -1 +1,57 @@
 package charter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// listTimeCutoff is how old a file must be before its listing shows the year
+// instead of the time of day, as in ls(1).
+const listTimeCutoff = 6 * 30 * 24 * time.Hour
+
+// writeList writes infos to w in the format of "ls -l", which is what most
+// clients expect in response to LIST.
+func writeList(w io.Writer, infos []os.FileInfo) error {
+	bw := bufio.NewWriter(w)
+	now := time.Now()
+	for _, fi := range infos {
+		_, _ = fmt.Fprintf(bw, "%s 1 ftp ftp %12d %s %s\r\n",
+			modeString(fi.Mode()), fi.Size(), listTime(fi.ModTime(), now), fi.Name())
+	}
+
+	return bw.Flush()
+}
+
+// writeNameList writes the names of infos to w, one per line, in response to
+// NLST.
+func writeNameList(w io.Writer, infos []os.FileInfo) error {
+	bw := bufio.NewWriter(w)
+	for _, fi := range infos {
+		_, _ = fmt.Fprintf(bw, "%s\r\n", fi.Name())
+	}
+
+	return bw.Flush()
+}
+
+// modeString formats mode like ls(1) does, e.g. "drwxr-xr-x".
+func modeString(mode os.FileMode) string {
+	kind := '-'
+	switch {
+	case mode&os.ModeDir != 0:
+		kind = 'd'
+	case mode&os.ModeSymlink != 0:
+		kind = 'l'
+	}
+
+	return string(kind) + mode.Perm().String()[1:]
+}
+
+func listTime(t time.Time, now time.Time) string {
+	if now.Sub(t) > listTimeCutoff || t.After(now) {
+		return t.Format("Jan _2  2006")
+	}
+	return t.Format("Jan _2 15:04")
+}
@@ -0,0 +1,294 @@
+package charter
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// defaultExtractMaxRatio is the default limit on the ratio of the size of an
+// archive's contents to that of the archive.
+const defaultExtractMaxRatio = 100
+
+var (
+	ErrUnsafeArchiveEntry = errors.New("archive entry points outside the destination")
+	ErrCompressionRatio   = errors.New("archive exceeds the decompression ratio limit")
+	ErrArchiveChanged     = errors.New("archive changed during extraction")
+)
+
+// archiveEntry describes an entry of an archive being extracted.
+type archiveEntry struct {
+	name     string // Slash-separated path relative to the destination.
+	mode     os.FileMode
+	size     int64
+	linkname string // Target of a symbolic link.
+}
+
+// entryFunc is called for each entry of an archive, with a reader of the
+// entry's contents.
+type entryFunc func(entry archiveEntry, r io.Reader) error
+
+// walkZip calls fn for each entry of the zip archive f.
+func walkZip(f *os.File, size int64, fn entryFunc) error {
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return err
+	}
+
+	for _, zf := range zr.File {
+		entry := archiveEntry{
+			name: zf.Name,
+			mode: zf.Mode(),
+			size: int64(zf.UncompressedSize64),
+		}
+
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		if entry.mode&os.ModeSymlink != 0 {
+			target, err := ioutil.ReadAll(io.LimitReader(rc, 4096))
+			if err != nil {
+				rc.Close()
+				return err
+			}
+			entry.linkname = string(target)
+		}
+
+		err = fn(entry, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkTar calls fn for each entry of the tar archive f, which may be
+// compressed with gzip. The size of the archive isn't needed.
+func walkTar(f *os.File, size int64, fn entryFunc) error {
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		entry := archiveEntry{
+			name:     hdr.Name,
+			mode:     hdr.FileInfo().Mode(),
+			size:     hdr.Size,
+			linkname: hdr.Linkname,
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			// Hard links are left out, like other special files.
+			entry.mode = os.ModeIrregular
+		}
+		if err := fn(entry, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// checkEntry validates the name and link target of an archive entry, so that
+// nothing is written outside the destination.
+func checkEntry(entry archiveEntry) error {
+	name := filepath.FromSlash(entry.name)
+	if path.IsAbs(entry.name) || filepath.IsAbs(name) || escapesRoot(name) {
+		return fmt.Errorf("%s: %v", entry.name, ErrUnsafeArchiveEntry)
+	}
+
+	if entry.mode&os.ModeSymlink != 0 {
+		target := path.Join(path.Dir(entry.name), entry.linkname)
+		if path.IsAbs(entry.linkname) || escapesRoot(filepath.FromSlash(target)) {
+			return fmt.Errorf("%s: %v", entry.name, ErrUnsafeArchiveEntry)
+		}
+	}
+	return nil
+}
+
+// extractArchive extracts the archive at realArchive into the virtual
+// directory vdest, whose real path is realDest, using walk to read it. The
+// archive is read twice: first to validate every entry and check the totals
+// against the quota and the decompression ratio limit, then to extract it.
+// Since the archive may be replaced in between, entries are validated again as
+// they are extracted, and extraction stops if they exceed the totals checked.
+// Existing files are never overwritten. It returns the number of files and
+// bytes extracted.
+func (client *Client) extractArchive(realArchive, vdest, realDest string, walk func(*os.File, int64, entryFunc) error, t *transfer) (files, bytes int64, err error) {
+	f, err := client.openReal(realArchive, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var total, count int64
+	err = walk(f, stat.Size(), func(entry archiveEntry, r io.Reader) error {
+		if err := checkEntry(entry); err != nil {
+			return err
+		}
+		if entry.mode.IsRegular() {
+			total += entry.size
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ratio := client.server.config.ExtractMaxRatio
+	if ratio <= 0 {
+		ratio = defaultExtractMaxRatio
+	}
+	if total > stat.Size()*ratio {
+		return 0, 0, ErrCompressionRatio
+	}
+
+	// The archive's contents are checked against the quota as a whole, so that
+	// an archive too large to fit isn't half extracted.
+	quotas := client.quotasFor(realDest)
+	if err := quotas.reserve(total, count); err != nil {
+		return 0, 0, err
+	}
+	quotas.release(total, count)
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	err = walk(f, stat.Size(), func(entry archiveEntry, r io.Reader) error {
+		if t.ctx.Err() != nil {
+			return errTransferAborted
+		}
+		if err := checkEntry(entry); err != nil {
+			return err
+		}
+		if entry.mode.IsRegular() && (files == count || entry.size > total-bytes) {
+			return ErrArchiveChanged
+		}
+
+		// Entries are resolved like any other path, so that symbolic links
+		// already in the tree can't lead out of it either.
+		realPath, err := client.writablePath(path.Join(vdest, entry.name))
+		if err != nil {
+			return fmt.Errorf("%s: %v", entry.name, err)
+		}
+
+		switch {
+		case entry.mode.IsDir():
+			err = client.mkdirAllReal(realPath, client.dirPerm())
+		case entry.mode.IsRegular():
+			if _, err = os.Lstat(realPath); err == nil {
+				err = os.ErrExist
+			} else if os.IsNotExist(err) {
+				err = client.mkdirAllReal(filepath.Dir(realPath), client.dirPerm())
+			}
+			if err == nil {
+				r = countingReader{r: contextReader{ctx: t.ctx, r: io.LimitReader(r, entry.size)}, n: &t.bytes}
+				err = client.writeFileAt(realPath, r, client.filePerm(), false, 0)
+			}
+			if err == nil {
+				files++
+				bytes += entry.size
+			}
+		case entry.mode&os.ModeSymlink != 0 && client.server.config.AllowSymlinks:
+			if err = client.mkdirAllReal(filepath.Dir(realPath), client.dirPerm()); err == nil {
+				err = symlinkBeneath(client.rootOf(realPath), entry.linkname, realPath)
+			}
+		}
+		if err != nil && err != errTransferAborted && err != ErrQuotaExceeded {
+			return fmt.Errorf("%s: %v", entry.name, pathErr(err))
+		}
+		return err
+	})
+
+	return files, bytes, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(cr.n, int64(n))
+	return n, err
+}
+
+// extractHandler returns the handler of SITE UNZIP or SITE UNTAR, which
+// extract an archive into the directory holding it, or into the given
+// directory. Extraction runs as a transfer, so it can be aborted with ABOR.
+func extractHandler(walk func(*os.File, int64, entryFunc) error) commandHandler {
+	return func(client *Client, command FtpCommand) (isExiting bool) {
+		start := time.Now()
+		t := client.currentTransfer()
+		arg := command.Value.(extractArg)
+
+		realArchive, err := client.realPath(arg.archive)
+		if err != nil {
+			_ = client.sendReply(550, "Can't extract %s: %v", arg.archive, err)
+			return
+		}
+
+		vdest := path.Dir(client.virtualPath(arg.archive))
+		if arg.dest != "" {
+			vdest = client.virtualPath(arg.dest)
+		}
+
+		// The destination may be a mount point; its entries are checked
+		// individually as they are extracted.
+		realDest, err := client.realPath(vdest)
+		if err != nil {
+			_ = client.sendReply(550, "Can't extract into %s: %v", vdest, err)
+			return
+		}
+
+		files, bytes, err := client.extractArchive(realArchive, vdest, realDest, walk, t)
+		if err != nil {
+			if t.isAborted() {
+				_ = client.sendReply(426, "Extraction aborted")
+			} else if err == ErrQuotaExceeded {
+				_ = client.sendReply(552, "Can't extract %s: Exceeded storage allocation", arg.archive)
+			} else {
+				_ = client.sendReply(550, "Can't extract %s: %v", arg.archive, pathErr(err))
+			}
+			return
+		}
+
+		_ = client.sendReply(250, "Extracted %d files into %s", files, vdest)
+		event := client.newEvent(EventExtract, vdest, realDest, bytes, start)
+		event.OldPath = client.virtualPath(arg.archive)
+		client.server.hooks.dispatch(event)
+		return
+	}
+}
@@ -0,0 +1,149 @@
+package charter
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeZipFile(t *testing.T, name string, files map[string]string) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for n, content := range files {
+		w, err := zw.Create(n)
+		assert.Nil(t, err)
+		_, _ = w.Write([]byte(content))
+	}
+	assert.Nil(t, zw.Close())
+	assert.Nil(t, ioutil.WriteFile(name, buf.Bytes(), 0644))
+}
+
+func writeTarGzFile(t *testing.T, name string, headers []*tar.Header, contents map[string]string) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, hdr := range headers {
+		hdr.Size = int64(len(contents[hdr.Name]))
+		assert.Nil(t, tw.WriteHeader(hdr))
+		_, _ = tw.Write([]byte(contents[hdr.Name]))
+	}
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, gw.Close())
+	assert.Nil(t, ioutil.WriteFile(name, buf.Bytes(), 0644))
+}
+
+func TestSiteUnzip(t *testing.T) {
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.Users = map[string]UserConf{"alice": {Quota: QuotaConf{Files: 5}}}
+	})
+	defer cleanup()
+
+	assert.Nil(t, os.Mkdir(filepath.Join(s.root, "in"), 0755))
+	writeZipFile(t, filepath.Join(s.root, "in/batch.zip"), map[string]string{
+		"a.txt":     "alpha",
+		"sub/b.txt": "beta",
+	})
+	writeZipFile(t, filepath.Join(s.root, "slip.zip"), map[string]string{
+		"ok.txt":           "fine",
+		"../../etc/passwd": "root",
+	})
+	writeZipFile(t, filepath.Join(s.root, "many.zip"), map[string]string{
+		"1": "", "2": "", "3": "",
+	})
+
+	s.expect("SITE UNZIP in/batch.zip", 250)
+	b, err := ioutil.ReadFile(filepath.Join(s.root, "in/sub/b.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "beta", string(b))
+
+	s.expect("SITE UNZIP in/batch.zip out", 250)
+	_, err = os.Stat(filepath.Join(s.root, "out/a.txt"))
+	assert.Nil(t, err)
+
+	assert.Contains(t, s.expect("SITE UNZIP slip.zip", 550), ErrUnsafeArchiveEntry.Error())
+	_, err = os.Stat(filepath.Join(s.root, "ok.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	s.expect("SITE UNZIP many.zip", 552)
+	s.expect("SITE UNZIP missing.zip", 550)
+}
+
+func TestSiteUntar(t *testing.T) {
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.AllowSymlinks = true
+		config.ExtractMaxRatio = 10
+	})
+	defer cleanup()
+
+	writeTarGzFile(t, filepath.Join(s.root, "site.tgz"), []*tar.Header{
+		{Name: "site/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "site/index.html", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "site/home.html", Typeflag: tar.TypeSymlink, Linkname: "index.html"},
+	}, map[string]string{"site/index.html": "<html>"})
+	writeTarGzFile(t, filepath.Join(s.root, "escape.tgz"), []*tar.Header{
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../outside"},
+	}, nil)
+	writeTarGzFile(t, filepath.Join(s.root, "bomb.tgz"), []*tar.Header{
+		{Name: "zeros", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string]string{"zeros": string(make([]byte, 1<<20))})
+
+	s.expect("SITE UNTAR site.tgz", 250)
+	b, err := ioutil.ReadFile(filepath.Join(s.root, "site/home.html"))
+	assert.Nil(t, err)
+	assert.Equal(t, "<html>", string(b))
+
+	// Existing files are left alone.
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(s.root, "site/index.html"), []byte("edited"), 0644))
+	assert.Contains(t, s.expect("SITE UNTAR site.tgz", 550), os.ErrExist.Error())
+	b, err = ioutil.ReadFile(filepath.Join(s.root, "site/index.html"))
+	assert.Nil(t, err)
+	assert.Equal(t, "edited", string(b))
+
+	assert.Contains(t, s.expect("SITE UNTAR escape.tgz", 550), ErrUnsafeArchiveEntry.Error())
+	assert.Contains(t, s.expect("SITE UNTAR bomb.tgz", 550), ErrCompressionRatio.Error())
+	_, err = os.Stat(filepath.Join(s.root, "zeros"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestExtractChangedArchive(t *testing.T) {
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.AllowSymlinks = true
+	})
+	defer cleanup()
+
+	// The archive is swapped for another one between the two passes.
+	var passes []archiveEntry
+	walk := func(f *os.File, size int64, fn entryFunc) error {
+		entry := passes[0]
+		passes = passes[1:]
+		return fn(entry, strings.NewReader(strings.Repeat("x", int(entry.size))))
+	}
+	SiteCommands["SWAPPED"] = Command{argc: 1, handler: extractHandler(walk), parse: parseExtractArg, transfer: true}
+	defer delete(SiteCommands, "SWAPPED")
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(s.root, "batch.tar"), make([]byte, 1024), 0644))
+
+	passes = []archiveEntry{
+		{name: "link", mode: os.ModeSymlink, linkname: "target"},
+		{name: "link", mode: os.ModeSymlink, linkname: "../outside"},
+	}
+	assert.Contains(t, s.expect("SITE SWAPPED batch.tar", 550), ErrUnsafeArchiveEntry.Error())
+	_, err := os.Lstat(filepath.Join(s.root, "link"))
+	assert.True(t, os.IsNotExist(err))
+
+	passes = []archiveEntry{
+		{name: "small", mode: 0644, size: 1},
+		{name: "small", mode: 0644, size: 1 << 20},
+	}
+	assert.Contains(t, s.expect("SITE SWAPPED batch.tar", 550), ErrArchiveChanged.Error())
+	_, err = os.Lstat(filepath.Join(s.root, "small"))
+	assert.True(t, os.IsNotExist(err))
+}
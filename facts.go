@@ -0,0 +1,113 @@
+package charter
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrCreateTimeUnsupported is returned when asked to set the creation time of
+// a file, which the host filesystems can't do.
+var ErrCreateTimeUnsupported = errors.New("creation time can't be set")
+
+// mffFacts lists the facts that MFF can change, with their canonical names.
+// See draft-somers-ftp-mfxx.
+var mffFacts = []string{"Modify", "UNIX.mode"}
+
+func lookupFact(name string) (string, bool) {
+	for _, f := range mffFacts {
+		if strings.EqualFold(f, name) {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+func mffFeature(client *Client) string {
+	return "MFF " + strings.Join(mffFacts, ";") + ";"
+}
+
+// setModTime sets the modification time of the file at realPath to t, leaving
+// its access time as it is.
+func (client *Client) setModTime(realPath string, t time.Time) error {
+	return client.chtimesReal(realPath, time.Time{}, t)
+}
+
+func mfmtHandler(client *Client, command FtpCommand) (isExiting bool) {
+	arg := command.Value.(timeArg)
+	realPath, err := client.writablePath(arg.path)
+	if err != nil {
+		_ = client.sendReply(550, "Can't set modification time of %s: %v", arg.path, err)
+		return
+	}
+
+	if err := client.setModTime(realPath, arg.time); err != nil {
+		_ = client.sendReply(550, "Can't set modification time of %s: %v", arg.path, pathErr(err))
+		return
+	}
+
+	_ = client.sendReply(213, "Modify=%s; %s", arg.time.UTC().Format(timeValLayout), arg.path)
+	return
+}
+
+// mfctHandler handles MFCT. The command is recognised, so that clients get a
+// meaningful error, but creation times can't be set, and MFCT isn't
+// advertised in FEAT.
+func mfctHandler(client *Client, command FtpCommand) (isExiting bool) {
+	arg := command.Value.(timeArg)
+	_ = client.sendReply(550, "Can't set creation time of %s: %v", arg.path, ErrCreateTimeUnsupported)
+	return
+}
+
+// mffHandler handles MFF. All facts are validated before any of them is
+// applied, so that an invalid one leaves the file untouched.
+func mffHandler(client *Client, command FtpCommand) (isExiting bool) {
+	arg := command.Value.(mffArg)
+	realPath, err := client.writablePath(arg.path)
+	if err != nil {
+		_ = client.sendReply(550, "Can't change facts of %s: %v", arg.path, err)
+		return
+	}
+
+	var modTime *time.Time
+	var mode *os.FileMode
+	for _, f := range arg.facts {
+		switch f.name {
+		case "Modify":
+			t, err := parseTimeVal(f.value)
+			if err != nil {
+				_ = client.sendReply(501, "Invalid value for Modify: %v", err)
+				return
+			}
+			modTime = &t
+		case "UNIX.mode":
+			m, err := strconv.ParseUint(f.value, 8, 32)
+			if err != nil || m > 0777 {
+				_ = client.sendReply(501, "Invalid value for UNIX.mode: %s", f.value)
+				return
+			}
+			fm := os.FileMode(m)
+			mode = &fm
+		}
+	}
+
+	if mode != nil {
+		err = client.chmodReal(realPath, *mode)
+	}
+	if err == nil && modTime != nil {
+		err = client.setModTime(realPath, *modTime)
+	}
+	if err != nil {
+		_ = client.sendReply(550, "Can't change facts of %s: %v", arg.path, pathErr(err))
+		return
+	}
+
+	var facts strings.Builder
+	for _, f := range arg.facts {
+		facts.WriteString(f.name + "=" + f.value + ";")
+	}
+	_ = client.sendReply(213, "%s %s", facts.String(), arg.path)
+	return
+}
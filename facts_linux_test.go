@@ -0,0 +1,31 @@
+package charter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMfmtKeepsAccessTime(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	p := filepath.Join(s.root, "f.txt")
+	atime := time.Date(2019, 5, 6, 7, 8, 9, 0, time.UTC)
+	assert.Nil(t, ioutil.WriteFile(p, []byte("data"), 0644))
+	assert.Nil(t, os.Chtimes(p, atime, atime))
+
+	s.expect("MFMT 20200102030405 f.txt", 213)
+	s.expect("MFF Modify=20210102030405; f.txt", 213)
+
+	stat, err := os.Stat(p)
+	assert.Nil(t, err)
+	assert.True(t, stat.ModTime().Equal(time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)))
+	st := stat.Sys().(*syscall.Stat_t)
+	assert.True(t, time.Unix(st.Atim.Unix()).Equal(atime))
+}
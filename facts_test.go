@@ -0,0 +1,41 @@
+package charter
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMfmt(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	assert.Nil(t, ioutil.WriteFile(s.root+"/my file.txt", []byte("data"), 0644))
+
+	feat := s.expect("FEAT", 211)
+	assert.Contains(t, feat, " MFMT\n")
+	assert.Contains(t, feat, " MFF Modify;UNIX.mode;\n")
+	assert.NotContains(t, feat, "MFCT")
+
+	assert.Equal(t, "Modify=20200102030405; my file.txt", s.expect("MFMT 20200102030405 my file.txt", 213))
+	stat, err := os.Stat(s.root + "/my file.txt")
+	assert.Nil(t, err)
+	assert.True(t, stat.ModTime().Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)))
+
+	s.expect("MFMT 2020 my file.txt", 501)
+	s.expect("MFMT 20200102030405 missing.txt", 550)
+	s.expect("MFCT 20200102030405 my file.txt", 550)
+
+	assert.Equal(t, "Modify=20210102030405;UNIX.mode=0600; my file.txt",
+		s.expect("MFF Modify=20210102030405;UNIX.mode=0600; my file.txt", 213))
+	stat, err = os.Stat(s.root + "/my file.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, 2021, stat.ModTime().UTC().Year())
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	s.expect("MFF Create=20210102030405; my file.txt", 504)
+	s.expect("MFF UNIX.mode=9; my file.txt", 501)
+}
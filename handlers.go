@@ -1,82 +1,149 @@
 package charter
 
 import (
-	"fmt"
+	"bytes"
+	"io"
+	"net"
 	"os"
 	"path/filepath"
-	"unicode"
+	"sort"
+	"strings"
+	"time"
 )
 
 func noopHandler(client *Client, command FtpCommand) (isExiting bool) {
+	_ = client.sendReply(200, "Zzz...")
 	return
 }
 
 func rmdHandler(client *Client, command FtpCommand) (isExiting bool) {
-	realDir := client.realPath(command.Params[0])
-	if err := os.Remove(realDir); err != nil {
-		_ = client.sendReply(550, "Can't remove directory: %v", err.(*os.PathError).Err)
+	start := time.Now()
+	paramDir := command.Arg
+	realDir, err := client.writableLinkPath(paramDir)
+	if err != nil {
+		_ = client.sendReply(550, "Can't remove directory: %v", err)
+		return
+	}
+
+	// Like rmdir(2), refuse anything but a directory, including a link to one.
+	if stat, err := os.Lstat(realDir); err != nil {
+		_ = client.sendReply(550, "Can't remove directory: %v", pathErr(err))
+		return
+	} else if !stat.IsDir() {
+		_ = client.sendReply(550, "Can't remove directory: %v", ErrNotDir)
+		return
+	}
+
+	if _, ok := client.server.trashFor(client.username); ok {
+		err = client.trashEmptyDir(realDir, client.virtualPath(paramDir))
+	} else {
+		err = removeBeneath(client.rootOf(realDir), realDir)
+	}
+
+	if err != nil {
+		_ = client.sendReply(550, "Can't remove directory: %v", pathErr(err))
 	} else {
 		_ = client.sendReply(250, "The directory was successfully removed")
+		client.fireEvent(EventRmdir, client.virtualPath(paramDir), realDir, 0, start)
 	}
 
 	return
 }
 
 func deleHandler(client *Client, command FtpCommand) (isExiting bool) {
-	paramPath := command.Params[0]
-	realPath := client.realPath(paramPath)
-	if stat, err := os.Stat(realPath); err != nil {
-		_ = client.sendReply(550, "Could not delete %s: %v", paramPath, err.(*os.PathError).Err)
+	start := time.Now()
+	paramPath := command.Arg
+	realPath, err := client.writableLinkPath(paramPath)
+	if err != nil {
+		_ = client.sendReply(550, "Could not delete %s: %v", paramPath, err)
+		return
+	}
+
+	stat, err := os.Lstat(realPath)
+	if err != nil {
+		_ = client.sendReply(550, "Could not delete %s: %v", paramPath, pathErr(err))
+		return
 	} else if stat.IsDir() {
 		_ = client.sendReply(550, "Could not delete %s: Invalid argument", paramPath)
+		return
 	}
 
-	if err := os.Remove(realPath); err != nil {
-		_ = client.sendReply(550, "Could not delete %s: %v", paramPath, err.(*os.PathError).Err)
+	if _, ok := client.server.trashFor(client.username); ok {
+		err = client.moveToTrash(realPath, client.virtualPath(paramPath))
+	} else if err = removeBeneath(client.rootOf(realPath), realPath); err == nil && stat.Mode().IsRegular() {
+		client.quotasFor(realPath).release(stat.Size(), 1)
 	}
 
+	if err != nil {
+		_ = client.sendReply(550, "Could not delete %s: %v", paramPath, pathErr(err))
+		return
+	}
+	_ = client.sendReply(250, "Deleted %s", paramPath)
+	client.fireEvent(EventDelete, client.virtualPath(paramPath), realPath, stat.Size(), start)
+
 	return
 }
 
 func mkdHandler(client *Client, command FtpCommand) (isExiting bool) {
-	paramDir := command.Params[0]
-	realDir := client.realPath(paramDir)
-	if err := os.Mkdir(realDir, 0755); err != nil {
-		_ = client.sendReply(550, "Can't create directory: %v", err.(*os.PathError).Err)
+	start := time.Now()
+	paramDir := command.Arg
+	realDir, err := client.writablePath(paramDir)
+	if err != nil {
+		_ = client.sendReply(550, "Can't create directory: %v", err)
+		return
+	}
+
+	err = mkdirBeneath(client.rootOf(realDir), realDir, client.dirPerm())
+	if err == nil {
+		err = client.chmodReal(realDir, client.dirPerm())
+	}
+	if err != nil {
+		_ = client.sendReply(550, "Can't create directory: %v", pathErr(err))
 	} else {
 		_ = client.sendReply(257, "%q : The directory was successfully created", paramDir)
+		client.fireEvent(EventMkdir, client.virtualPath(paramDir), realDir, 0, start)
 	}
 
 	return
 }
 
 func userHandler(client *Client, command FtpCommand) (isExiting bool) {
-	client.username = command.Params[0]
+	// A new USER starts the login sequence again, flushing the credentials
+	// already given but keeping the transfer parameters.
+	client.logout()
+	if !validUsername(command.Arg) {
+		_ = client.sendReply(501, "Invalid user name")
+		return
+	}
+	client.username = command.Arg
+	client.state = stateUserGiven
 	_ = client.sendReply(331, "User %s OK. Password required", client.username)
 	return
 }
 
 func passHandler(client *Client, command FtpCommand) (isExiting bool) {
-	if client.username == "" {
+	switch client.state {
+	case stateConnected:
 		_ = client.sendReply(503, "Login with USER first.")
-	} else {
-		client.isRegistered = true
+	case stateLoggedIn:
+		_ = client.sendReply(503, "Already logged in.")
+	default:
+		if err := client.server.authenticate(client.username, command.Arg); err != nil {
+			client.logout()
+			_ = client.sendReply(530, "Login incorrect.")
+			return
+		}
+
+		client.state = stateLoggedIn
+		client.mounts = newMountTable(client.server.config, client.username)
+		client.quotas = client.server.quotasFor(client.username, client.mounts)
 		_ = client.sendReply(230, "OK. Current directory is %s", client.workingDir)
 	}
 	return
 }
 
 func cwdHandler(client *Client, command FtpCommand) (isExiting bool) {
-	var newDir string
-	paramDir := command.Params[0]
-
-	// If the new directory's path is relative, join it with the current working directory. If it's
-	// absolute, then use it directly.
-	if filepath.IsAbs(paramDir) {
-		newDir = paramDir
-	} else {
-		newDir = filepath.Join(client.workingDir, paramDir)
-	}
+	newDir := client.virtualPath(command.Arg)
 
 	// Verify new working directory exists.
 	if err := client.verifyDir(newDir); err != nil {
@@ -98,7 +165,30 @@ func cdupHandler(client *Client, command FtpCommand) (isExiting bool) {
 	return
 }
 
+func portHandler(client *Client, command FtpCommand) (isExiting bool) {
+	addr := command.Value.(*net.TCPAddr)
+
+	// Only connect back to the client itself, and never to a privileged port,
+	// so that the server can't be used to bounce connections to other hosts.
+	if host, _, err := net.SplitHostPort(client.ctrlConn.RemoteAddr().String()); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.Equal(addr.IP) {
+			_ = client.sendReply(500, "Illegal PORT command: address doesn't match the control connection")
+			return
+		}
+	}
+	if addr.Port < 1024 {
+		_ = client.sendReply(500, "Illegal PORT command: privileged port")
+		return
+	}
+
+	client.closeDataListener()
+	client.activeAddr = addr
+	_ = client.sendReply(200, "PORT command successful")
+	return
+}
+
 func pasvHandler(client *Client, command FtpCommand) (isExiting bool) {
+	client.activeAddr = nil
 	prevPort := client.dataPort
 	client.dataPort, client.dataLis = client.server.reserveDataPort()
 
@@ -118,47 +208,160 @@ func pasvHandler(client *Client, command FtpCommand) (isExiting bool) {
 }
 
 func modeHandler(client *Client, command FtpCommand) (isExiting bool) {
-	mode := unicode.ToLower(rune(command.Params[0][0]))
-	if mode == 's' {
-		_ = client.sendReply(200, "S OK")
-	} else {
-		_ = client.sendReply(504, "Please use (S)tream mode")
+	switch mode := command.Value.(transmissionMode); mode {
+	case ModeStream, ModeBlock, ModeDeflate:
+		client.mode = mode
+		_ = client.sendReply(200, "Mode set to %s", mode)
+	default:
+		_ = client.sendReply(504, "Please use (S)tream, (B)lock or (Z)lib mode")
 	}
 	return
 }
 
 func listHandler(client *Client, command FtpCommand) (isExiting bool) {
+	return sendListing(client, command, writeList)
+}
+
+func appeHandler(client *Client, command FtpCommand) (isExiting bool) {
+	start := time.Now()
 	if !client.ensureDataConn() {
 		return
 	}
 	defer client.dataConn.Close()
 
-	// Send over the data connection.
-	_, _ = fmt.Fprintf(client.dataConn, "list")
+	paramPath := command.Arg
+	realPath, err := client.writablePath(paramPath)
+	if err != nil {
+		_ = client.sendReply(550, "Can't open %s: %v", paramPath, err)
+		return
+	}
+
+	_ = client.sendReply(150, "Ok to send data")
+	r, err := client.dataReader()
+	if err == nil {
+		err = client.writeFile(realPath, r, client.filePerm(), true, 0)
+	}
+	if err == nil {
+		_ = client.sendReply(226, "Transfer complete")
+		client.fireUploadEvent(EventAppend, paramPath, realPath, start)
+	} else {
+		if client.transferAborted() {
+			_ = client.sendReply(426, "Connection closed; transfer aborted")
+		} else if v, ok := err.(*os.PathError); ok {
+			_ = client.sendReply(550, "Can't open %s: %v", paramPath, v.Err)
+		} else if err == ErrQuotaExceeded {
+			_ = client.sendReply(552, "Can't append to %s: Exceeded storage allocation", paramPath)
+		} else {
+			_ = client.sendReply(550, "Can't append to %s: %v", paramPath, err)
+		}
+	}
+
 	return
 }
 
-func appeHandler(client *Client, command FtpCommand) (isExiting bool) {
+func retrHandler(client *Client, command FtpCommand) (isExiting bool) {
+	paramPath := command.Arg
+	offset := client.restOffset
+	client.restOffset = 0
+
+	f, stat, err := client.openFile(paramPath)
+	if os.IsNotExist(err) {
+		if src, ok := client.archiveSourceFor(paramPath); ok {
+			sendArchive(client, paramPath, src, offset)
+			return
+		}
+	}
+	if err != nil {
+		_ = client.sendReply(550, "Can't open %s: %v", paramPath, pathErr(err))
+		return
+	}
+	defer f.Close()
+
+	// In binary mode, seek straight to the restart offset. In ASCII mode, the
+	// offset is into the translated data, which is skipped as it is sent.
+	var skip int64
+	if client.translateASCII() {
+		skip = offset
+	} else if offset > stat.Size() {
+		_ = client.sendReply(554, "Can't resume %s at offset %d", paramPath, offset)
+		return
+	} else if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		_ = client.sendReply(554, "Can't resume %s at offset %d", paramPath, offset)
+		return
+	}
+
 	if !client.ensureDataConn() {
 		return
 	}
 	defer client.dataConn.Close()
 
-	paramPath := command.Params[0]
-	realPath := client.realPath(paramPath)
-	err := client.writeFile(realPath, client.dataConn, 0644, true)
+	_ = client.sendReply(150, "Opening %s mode data connection for %s (%d bytes)",
+		client.dataType, paramPath, stat.Size())
+	w := client.structureWriter(client.dataWriter())
+	if client.translateASCII() {
+		err = sendASCII(&skipWriter{w: w, skip: skip}, f)
+	} else {
+		_, err = io.Copy(w, f)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+
+	// The client considers the transfer complete once the data connection is
+	// closed, so do that before replying.
+	if err == nil {
+		err = client.dataConn.Close()
+	}
 	if err != nil {
-		if v, ok := err.(*os.PathError); ok {
-			_ = client.sendReply(550, "Can't open %s: %v", paramPath, v.Err)
-		} else {
-			_ = client.sendReply(550, "Can't append to %s: %v", paramPath, err)
+		_ = client.sendReply(426, "Connection closed; transfer aborted")
+		return
+	}
+
+	_ = client.sendReply(226, "Transfer complete")
+	client.server.recordDownload(f.Name())
+	return
+}
+
+func sizeHandler(client *Client, command FtpCommand) (isExiting bool) {
+	paramPath := command.Arg
+	realPath, err := client.realPath(paramPath)
+	if err != nil {
+		_ = client.sendReply(550, "Could not get file size: %v", err)
+		return
+	}
+
+	// Until an interrupted upload is resumed, report the size of what was kept
+	// of it, which is the offset to resume from with REST.
+	stat, err := os.Stat(realPath)
+	if os.IsNotExist(err) {
+		if tmp, partial, ok := client.partialUpload(realPath); ok {
+			realPath, stat, err = tmp, partial, nil
+		}
+	}
+	if err != nil {
+		_ = client.sendReply(550, "Could not get file size: %v", pathErr(err))
+		return
+	} else if !stat.Mode().IsRegular() {
+		_ = client.sendReply(550, "%s: not a plain file", paramPath)
+		return
+	}
+
+	// In ASCII mode, report the number of bytes that RETR would transfer.
+	size := stat.Size()
+	if client.dataType == TypeASCII {
+		if size, err = client.asciiFileOffset(realPath, -1); err != nil {
+			_ = client.sendReply(550, "Could not get file size: %v", pathErr(err))
+			return
 		}
 	}
 
+	_ = client.sendReply(213, "%d", size)
 	return
 }
 
 func storHandler(client *Client, command FtpCommand) (isExiting bool) {
+	start := time.Now()
+
 	// Get source data connection.
 	if !client.ensureDataConn() {
 		return
@@ -166,12 +369,32 @@ func storHandler(client *Client, command FtpCommand) (isExiting bool) {
 	defer client.dataConn.Close()
 
 	// Set up destination file.
-	paramPath := command.Params[0]
-	realPath := client.realPath(paramPath)
-	err := client.writeFile(realPath, client.dataConn, 0644, false)
+	paramPath := command.Arg
+	realPath, err := client.writablePath(paramPath)
 	if err != nil {
-		if v, ok := err.(*os.PathError); ok {
+		_ = client.sendReply(550, "Can't open %s: %v", paramPath, err)
+		return
+	}
+
+	offset := client.restOffset
+	client.restOffset = 0
+	_ = client.sendReply(150, "Ok to send data")
+	r, err := client.dataReader()
+	if err == nil {
+		err = client.writeFile(realPath, r, client.filePerm(), false, offset)
+	}
+	if err == nil {
+		_ = client.sendReply(226, "Transfer complete")
+		client.fireUploadEvent(EventUpload, paramPath, realPath, start)
+	} else {
+		if client.transferAborted() {
+			_ = client.sendReply(426, "Connection closed; transfer aborted")
+		} else if v, ok := err.(*os.PathError); ok {
 			_ = client.sendReply(550, "Can't open %s: %v", paramPath, v.Err)
+		} else if err == ErrInvalidRestart {
+			_ = client.sendReply(554, "Can't resume %s at offset %d", paramPath, offset)
+		} else if err == ErrQuotaExceeded {
+			_ = client.sendReply(552, "Can't store %s: Exceeded storage allocation", paramPath)
 		} else {
 			_ = client.sendReply(550, "Can't store %s: %v", paramPath, err)
 		}
@@ -180,14 +403,195 @@ func storHandler(client *Client, command FtpCommand) (isExiting bool) {
 	return
 }
 
+// stouHandler handles STOU, storing the upload under a name chosen by the
+// server. The name is derived from the argument, if given, and is reported in
+// the 150 reply in the "FILE: name" form of RFC 1123, section 4.1.2.9.
+func stouHandler(client *Client, command FtpCommand) (isExiting bool) {
+	start := time.Now()
+
+	if !client.ensureDataConn() {
+		return
+	}
+	defer client.dataConn.Close()
+
+	prefix := command.Arg
+	if prefix == "" {
+		prefix = "stou"
+	}
+	name, realPath, err := client.createUnique(prefix)
+	if err != nil {
+		if err == ErrQuotaExceeded {
+			_ = client.sendReply(552, "Can't create %s: Exceeded storage allocation", prefix)
+		} else {
+			_ = client.sendReply(553, "Can't create unique file from %s: %v", prefix, pathErr(err))
+		}
+		return
+	}
+
+	_ = client.sendReply(150, "FILE: %s", name)
+	r, err := client.dataReader()
+	if err == nil {
+		err = client.writeNewFile(realPath, r, client.filePerm())
+	}
+	if err != nil {
+		// With atomic uploads, nothing was written to the reserved name.
+		if client.server.config.AtomicUploads {
+			_ = client.removeFile(realPath)
+		}
+
+		if client.transferAborted() {
+			_ = client.sendReply(426, "Connection closed; transfer aborted")
+		} else if err == ErrQuotaExceeded {
+			_ = client.sendReply(552, "Can't store %s: Exceeded storage allocation", name)
+		} else {
+			_ = client.sendReply(550, "Can't store %s: %v", name, pathErr(err))
+		}
+		return
+	}
+
+	_ = client.sendReply(226, "Transfer complete (unique file name: %s)", name)
+	client.fireUploadEvent(EventUpload, name, realPath, start)
+	return
+}
+
+func rnfrHandler(client *Client, command FtpCommand) (isExiting bool) {
+	paramPath := command.Arg
+	realPath, err := client.writableLinkPath(paramPath)
+	if err != nil {
+		_ = client.sendReply(550, "Can't rename %s: %v", paramPath, err)
+		return
+	}
+
+	if _, err := os.Lstat(realPath); err != nil {
+		_ = client.sendReply(550, "Can't rename %s: %v", paramPath, pathErr(err))
+		return
+	}
+
+	client.renameFrom = client.virtualPath(paramPath)
+	_ = client.sendReply(350, "RNFR accepted - file exists, ready for destination")
+	return
+}
+
+func rntoHandler(client *Client, command FtpCommand) (isExiting bool) {
+	start := time.Now()
+	fromPath := client.renameFrom
+	client.renameFrom = ""
+	if fromPath == "" {
+		_ = client.sendReply(503, "Need RNFR before RNTO")
+		return
+	}
+
+	// Resolve the source again, in case the tree changed since RNFR.
+	realFrom, err := client.writableLinkPath(fromPath)
+	if err != nil {
+		_ = client.sendReply(550, "Can't rename %s: %v", fromPath, err)
+		return
+	}
+
+	paramPath := command.Arg
+	realTo, err := client.writableLinkPath(paramPath)
+	if err != nil {
+		_ = client.sendReply(553, "Can't rename to %s: %v", paramPath, err)
+		return
+	}
+
+	// Links moved to a different depth mustn't end up pointing out of the
+	// mount.
+	if err := checkMovedLinks(client.rootOf(realTo), realFrom, realTo); err != nil {
+		_ = client.sendReply(550, "Can't rename to %s: %v", paramPath, pathErr(err))
+		return
+	}
+
+	if err := client.moveFile(realFrom, realTo); err != nil {
+		if err == ErrQuotaExceeded {
+			_ = client.sendReply(552, "Can't rename to %s: Exceeded storage allocation", paramPath)
+		} else {
+			_ = client.sendReply(550, "Can't rename to %s: %v", paramPath, pathErr(err))
+		}
+		return
+	}
+
+	_ = client.sendReply(250, "File successfully renamed or moved")
+	event := client.newEvent(EventRename, client.virtualPath(paramPath), realTo, 0, start)
+	event.OldPath = fromPath
+	client.server.hooks.dispatch(event)
+	return
+}
+
+func restHandler(client *Client, command FtpCommand) (isExiting bool) {
+	offset := command.Value.(int64)
+	if client.structure == StructureRecord {
+		_ = client.sendReply(504, "REST not supported with record structure")
+		return
+	}
+
+	client.restOffset = offset
+	_ = client.sendReply(350, "Restarting at %d. Send STORE or RETRIEVE to initiate transfer", offset)
+	return
+}
+
 func nlstHandler(client *Client, command FtpCommand) (isExiting bool) {
+	return sendListing(client, command, writeNameList)
+}
+
+// sendListing lists the directory named by the command's first non-option
+// parameter, or the working directory if there isn't one, over the data
+// connection.
+func sendListing(client *Client, command FtpCommand, write func(io.Writer, []os.FileInfo) error) (isExiting bool) {
+	dir := client.workingDir
+	opts, pathname := splitListArg(command.Arg)
+	showHidden := strings.ContainsRune(opts, 'a')
+	if pathname != "" {
+		dir = client.virtualPath(pathname)
+	}
+
+	infos, err := client.listDir(dir)
+	if err != nil {
+		_ = client.sendReply(550, "Can't list %s: %v", dir, err)
+		return
+	}
+
+	// Like ls(1), hide dot files such as partial uploads unless asked not to.
+	if !showHidden {
+		visible := infos[:0]
+		for _, fi := range infos {
+			if !strings.HasPrefix(fi.Name(), ".") {
+				visible = append(visible, fi)
+			}
+		}
+		infos = visible
+	}
+
 	if !client.ensureDataConn() {
 		return
 	}
 	defer client.dataConn.Close()
 
-	// Send over the data connection.
-	_, _ = fmt.Fprintf(client.dataConn, "nlst")
+	// Names are transcoded as a whole, since a listing in a legacy charset is
+	// no longer valid UTF-8.
+	dw := client.dataWriter()
+	var w io.Writer = dw
+	var buf bytes.Buffer
+	if client.legacy() {
+		w = &buf
+	}
+
+	_ = client.sendReply(150, "Here comes the directory listing")
+	err = write(w, infos)
+	if err == nil && client.legacy() {
+		_, err = io.WriteString(dw, client.encodeText(buf.String()))
+	}
+	if err == nil {
+		err = dw.Close()
+	}
+	if err == nil {
+		err = client.dataConn.Close()
+	}
+	if err != nil {
+		_ = client.sendReply(426, "Connection closed; transfer aborted")
+		return
+	}
+	_ = client.sendReply(226, "Directory send OK")
 	return
 }
 
@@ -202,15 +606,49 @@ func quitHandler(client *Client, command FtpCommand) bool {
 
 func typeHandler(client *Client, command FtpCommand) bool {
 	// Currently support ASCII and Image types.
-	if unicode.ToLower(rune(command.Params[1][0])) == 'a' {
+	client.dataType = command.Value.(typeArg).dataType
+	if client.dataType == TypeASCII {
 		client.sendReply(200, "TYPE is now ASCII")
-	} else if unicode.ToLower(rune(command.Params[1][0])) == 'i' {
+	} else {
 		client.sendReply(200, "TYPE is now 8-bit binary")
 	}
 
 	return false
 }
 
+func featHandler(client *Client, command FtpCommand) (isExiting bool) {
+	var feats []string
+	for _, table := range []map[string]Command{Commands, extensions} {
+		for _, cmd := range table {
+			if cmd.feature == nil {
+				continue
+			}
+			if feat := cmd.feature(client); feat != "" {
+				feats = append(feats, feat)
+			}
+		}
+	}
+	sort.Strings(feats)
+
+	_ = client.sendMultilineReply(211, "Extensions supported:", feats, "End")
+	return
+}
+
+func optsHandler(client *Client, command FtpCommand) (isExiting bool) {
+	opt, _ := ParseLine(command.Arg)
+	name := strings.ToUpper(opt.Command)
+	cmd, ok := Commands[name]
+	if !ok {
+		cmd, ok = extensions[name]
+	}
+	if !ok || cmd.opts == nil {
+		_ = client.sendReply(501, "Option not understood for %s", name)
+		return
+	}
+
+	return cmd.opts(client, opt)
+}
+
 func notImplementedHandler(client *Client, command FtpCommand) bool {
 	_ = client.sendReply(502, "Command not implemented.")
 	return false
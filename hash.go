@@ -0,0 +1,156 @@
+package charter
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+var ErrInvalidRange = errors.New("invalid byte range")
+
+// hashAlgorithm is a hash function available to HASH, as named in the HASH
+// extension. See draft-bryan-ftp-hash.
+type hashAlgorithm struct {
+	name string
+	new  func() hash.Hash
+}
+
+// hashAlgorithms lists the algorithms available to HASH, the first being the
+// default.
+var hashAlgorithms = []hashAlgorithm{
+	{"SHA-256", sha256.New},
+	{"SHA-1", sha1.New},
+	{"MD5", md5.New},
+	{"CRC32", func() hash.Hash { return crc32.NewIEEE() }},
+}
+
+func lookupHash(name string) (hashAlgorithm, bool) {
+	for _, algo := range hashAlgorithms {
+		if strings.EqualFold(algo.name, name) {
+			return algo, true
+		}
+	}
+	return hashAlgorithm{}, false
+}
+
+// hashFile hashes the bytes of the file at p within rng, resolving p like RETR
+// does. It returns the range actually hashed, with an end no further than the
+// last byte of the file.
+func (client *Client) hashFile(p string, algo hashAlgorithm, rng byteRange) (string, byteRange, error) {
+	f, stat, err := client.openFile(p)
+	if err != nil {
+		return "", rng, err
+	}
+	defer f.Close()
+
+	size := stat.Size()
+	if rng.end < 0 || rng.end >= size {
+		rng.end = size - 1
+	}
+	if rng.start > 0 && rng.start >= size {
+		return "", rng, ErrInvalidRange
+	}
+	if rng.end < rng.start {
+		rng.end = rng.start
+	}
+
+	h := algo.new()
+	if _, err := io.Copy(h, io.NewSectionReader(f, rng.start, rng.end-rng.start+1)); err != nil {
+		return "", rng, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), rng, nil
+}
+
+func hashFeature(client *Client) string {
+	names := make([]string, len(hashAlgorithms))
+	for i, algo := range hashAlgorithms {
+		names[i] = algo.name
+		if algo.name == client.hashAlgo.name {
+			names[i] += "*"
+		}
+	}
+
+	return "HASH " + strings.Join(names, ";")
+}
+
+// hashOptsHandler handles OPTS HASH, which reports the selected algorithm, or
+// selects another one.
+func hashOptsHandler(client *Client, command FtpCommand) (isExiting bool) {
+	if command.Arg == "" {
+		_ = client.sendReply(200, "%s", client.hashAlgo.name)
+		return
+	}
+
+	algo, ok := lookupHash(strings.TrimSpace(command.Arg))
+	if !ok {
+		_ = client.sendReply(501, "Unknown algorithm, current selection not changed")
+		return
+	}
+
+	client.hashAlgo = algo
+	_ = client.sendReply(200, "%s", algo.name)
+	return
+}
+
+func hashHandler(client *Client, command FtpCommand) (isExiting bool) {
+	paramPath := command.Arg
+	rng := byteRange{start: 0, end: -1}
+	if client.hashRange != nil {
+		rng = *client.hashRange
+		client.hashRange = nil
+	}
+
+	sum, rng, err := client.hashFile(paramPath, client.hashAlgo, rng)
+	if err == ErrInvalidRange {
+		_ = client.sendReply(501, "Can't hash %s: %v", paramPath, err)
+		return
+	} else if err != nil {
+		_ = client.sendReply(550, "Can't hash %s: %v", paramPath, pathErr(err))
+		return
+	}
+
+	_ = client.sendReply(213, "%s %d-%d %s %s", client.hashAlgo.name, rng.start, rng.end, sum, paramPath)
+	return
+}
+
+// rangHandler handles RANG, which sets the range of bytes hashed by the
+// following HASH. "RANG 1 0" resets the range. See draft-bryan-ftp-range.
+func rangHandler(client *Client, command FtpCommand) (isExiting bool) {
+	rng := command.Value.(byteRange)
+	if rng.start == 1 && rng.end == 0 {
+		client.hashRange = nil
+		_ = client.sendReply(350, "Byte range reset")
+		return
+	}
+
+	client.hashRange = &rng
+	_ = client.sendReply(350, "Restarting at %d. Ending byte range at %d", rng.start, rng.end)
+	return
+}
+
+// legacyHashHandler returns the handler of one of the XCRC, XMD5, XSHA1 and
+// XSHA256 commands, which hash a file, or a range of it, with a fixed
+// algorithm.
+func legacyHashHandler(name string) commandHandler {
+	algo, _ := lookupHash(name)
+	return func(client *Client, command FtpCommand) (isExiting bool) {
+		arg := command.Value.(hashArg)
+		sum, _, err := client.hashFile(arg.path, algo, arg.rng)
+		if err == ErrInvalidRange {
+			_ = client.sendReply(501, "Can't hash %s: %v", arg.path, err)
+			return
+		} else if err != nil {
+			_ = client.sendReply(550, "Can't hash %s: %v", arg.path, pathErr(err))
+			return
+		}
+
+		_ = client.sendReply(250, "%s", strings.ToUpper(sum))
+		return
+	}
+}
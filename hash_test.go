@@ -0,0 +1,58 @@
+package charter
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHashArg(t *testing.T) {
+	v, err := parseHashArg("file.bin")
+	assert.Nil(t, err)
+	assert.Equal(t, hashArg{path: "file.bin", rng: byteRange{0, -1}}, v)
+
+	v, err = parseHashArg(`"my file 2" 10 20`)
+	assert.Nil(t, err)
+	assert.Equal(t, hashArg{path: "my file 2", rng: byteRange{10, 20}}, v)
+
+	v, err = parseHashArg("my file 10 20")
+	assert.Nil(t, err)
+	assert.Equal(t, hashArg{path: "my file", rng: byteRange{10, 20}}, v)
+
+	v, err = parseHashArg("take 5 5")
+	assert.Nil(t, err)
+	assert.Equal(t, hashArg{path: "take", rng: byteRange{5, 5}}, v)
+
+	v, err = parseHashArg("release 2")
+	assert.Nil(t, err)
+	assert.Equal(t, hashArg{path: "release 2", rng: byteRange{0, -1}}, v)
+
+	_, err = parseRange("20 10")
+	assert.NotNil(t, err)
+}
+
+func TestHash(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	assert.Nil(t, ioutil.WriteFile(s.root+"/hello.txt", []byte("hello world"), 0644))
+
+	assert.Contains(t, s.expect("FEAT", 211), "HASH SHA-256*;SHA-1;MD5;CRC32")
+	assert.Equal(t, "SHA-256 0-10 b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9 hello.txt",
+		s.expect("HASH hello.txt", 213))
+
+	assert.Equal(t, "MD5", s.expect("OPTS HASH md5", 200))
+	s.expect("OPTS HASH SHA-512", 501)
+	s.expect("RANG 0 4", 350)
+	assert.Equal(t, "MD5 0-4 5d41402abc4b2a76b9719d911017c592 hello.txt", s.expect("HASH hello.txt", 213))
+	assert.Equal(t, "MD5 0-10 5eb63bbbe01eeed093cb22bb8f5acdc3 hello.txt", s.expect("HASH hello.txt", 213))
+
+	s.expect("HASH missing.txt", 550)
+	s.expect("HASH /", 550)
+
+	assert.Equal(t, "0D4A1185", s.expect("XCRC hello.txt", 250))
+	assert.Equal(t, "5D41402ABC4B2A76B9719D911017C592", s.expect("XMD5 hello.txt 0 4", 250))
+	assert.Equal(t, "2AAE6C35C94FCFB415DBE95F408B9CE91EE846ED", s.expect("XSHA1 hello.txt", 250))
+	s.expect("XSHA256 hello.txt 20 30", 501)
+}
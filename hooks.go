@@ -0,0 +1,298 @@
+package charter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kinds of events passed to hooks.
+const (
+	EventUpload  = "upload"
+	EventAppend  = "append"
+	EventDelete  = "delete"
+	EventMkdir   = "mkdir"
+	EventRmdir   = "rmdir"
+	EventRename  = "rename"
+	EventCopy    = "copy"
+	EventExtract = "extract"
+	EventRestore = "restore"
+)
+
+const (
+	defaultHookQueueSize = 64
+	defaultHookBackoff   = time.Second
+	defaultHookTimeout   = 30 * time.Second
+)
+
+// Event describes a change made to the filesystem by a client.
+type Event struct {
+	Kind       string        `json:"event"`
+	User       string        `json:"user"`
+	RemoteAddr string        `json:"remote_addr"`
+	Path       string        `json:"path"`               // Virtual path, as seen by the client.
+	RealPath   string        `json:"real_path"`          // Path on the host.
+	OldPath    string        `json:"old_path,omitempty"` // Virtual path before a rename, or of the source of a copy or extraction.
+	Size       int64         `json:"size"`
+	Duration   time.Duration `json:"duration"`
+	Time       time.Time     `json:"time"`
+}
+
+// Hook is notified of events. Hooks run asynchronously to the sessions that
+// cause the events; if Handle returns an error, delivery is retried with
+// exponential backoff.
+type Hook interface {
+	Handle(event Event) error
+}
+
+// HookFunc adapts a function to the Hook interface.
+type HookFunc func(event Event) error
+
+func (f HookFunc) Handle(event Event) error {
+	return f(event)
+}
+
+// CommandHook runs an external command for each event. The event is passed to
+// the command through CHARTER_* environment variables, and a non-zero exit
+// status is treated as a failure. A command still running after Timeout, 30
+// seconds by default, is killed.
+type CommandHook struct {
+	Path    string
+	Args    []string
+	Timeout time.Duration
+}
+
+func (h CommandHook) Handle(event Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout(h.Timeout))
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.Path, h.Args...)
+	cmd.Env = append(os.Environ(),
+		"CHARTER_EVENT="+event.Kind,
+		"CHARTER_USER="+event.User,
+		"CHARTER_REMOTE_ADDR="+event.RemoteAddr,
+		"CHARTER_PATH="+event.Path,
+		"CHARTER_REAL_PATH="+event.RealPath,
+		"CHARTER_OLD_PATH="+event.OldPath,
+		"CHARTER_SIZE="+strconv.FormatInt(event.Size, 10),
+		"CHARTER_DURATION_MS="+strconv.FormatInt(int64(event.Duration/time.Millisecond), 10),
+	)
+
+	return cmd.Run()
+}
+
+// WebhookHook POSTs each event as a JSON object to URL. Any response other
+// than 2xx is treated as a failure, as is no response within Timeout, 30
+// seconds by default.
+type WebhookHook struct {
+	URL     string
+	Client  *http.Client
+	Timeout time.Duration
+}
+
+func (h WebhookHook) Handle(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout(h.Timeout))
+	defer cancel()
+
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s: %s", h.URL, resp.Status)
+	}
+	return nil
+}
+
+func hookTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return defaultHookTimeout
+	}
+	return timeout
+}
+
+// HookConf configures an external command or webhook to be notified of the
+// given kinds of events. If Events is empty, the hook receives every event.
+// TimeoutSeconds overrides the server's hook-timeout-seconds.
+type HookConf struct {
+	Events         []string
+	Command        []string
+	URL            string
+	TimeoutSeconds int `toml:"timeout-seconds"`
+}
+
+// hookRunner delivers events to a single hook from its own bounded queue, so
+// that a slow hook doesn't hold up the others.
+type hookRunner struct {
+	hook    Hook
+	events  map[string]bool
+	queue   chan Event
+	retries int
+	backoff time.Duration
+}
+
+func (r *hookRunner) wants(kind string) bool {
+	return len(r.events) == 0 || r.events[kind]
+}
+
+func (r *hookRunner) run() {
+	for event := range r.queue {
+		backoff := r.backoff
+		for attempt := 0; ; attempt++ {
+			err := r.hook.Handle(event)
+			if err == nil {
+				break
+			}
+			if attempt >= r.retries {
+				log.Printf("charter: dropping %s event for %s: %v", event.Kind, event.Path, err)
+				break
+			}
+
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// hookDispatcher fans events out to the registered hooks.
+type hookDispatcher struct {
+	mu        sync.RWMutex
+	runners   []*hookRunner
+	queueSize int
+	retries   int
+	backoff   time.Duration
+}
+
+func newHookDispatcher(config *Config) *hookDispatcher {
+	d := &hookDispatcher{
+		queueSize: config.HookQueueSize,
+		retries:   config.HookRetries,
+		backoff:   defaultHookBackoff,
+	}
+	if d.queueSize <= 0 {
+		d.queueSize = defaultHookQueueSize
+	}
+
+	for _, conf := range config.Hook {
+		timeout := time.Duration(config.HookTimeoutSeconds) * time.Second
+		if conf.TimeoutSeconds > 0 {
+			timeout = time.Duration(conf.TimeoutSeconds) * time.Second
+		}
+
+		if len(conf.Command) > 0 {
+			d.add(CommandHook{Path: conf.Command[0], Args: conf.Command[1:], Timeout: timeout}, conf.Events)
+		}
+		if conf.URL != "" {
+			d.add(WebhookHook{URL: conf.URL, Timeout: timeout}, conf.Events)
+		}
+	}
+
+	return d
+}
+
+func (d *hookDispatcher) add(hook Hook, events []string) {
+	r := &hookRunner{
+		hook:    hook,
+		events:  make(map[string]bool),
+		queue:   make(chan Event, d.queueSize),
+		retries: d.retries,
+		backoff: d.backoff,
+	}
+	for _, kind := range events {
+		r.events[kind] = true
+	}
+
+	d.mu.Lock()
+	d.runners = append(d.runners, r)
+	d.mu.Unlock()
+
+	go r.run()
+}
+
+// dispatch queues event for every hook interested in it. Events are dropped,
+// rather than blocking the session, if a hook's queue is full.
+func (d *hookDispatcher) dispatch(event Event) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, r := range d.runners {
+		if !r.wants(event.Kind) {
+			continue
+		}
+
+		select {
+		case r.queue <- event:
+		default:
+			log.Printf("charter: hook queue full, dropping %s event for %s", event.Kind, event.Path)
+		}
+	}
+}
+
+// AddHook registers hook to be notified of the given kinds of events, or of
+// every event if none are given.
+func (srv *Server) AddHook(hook Hook, events ...string) {
+	srv.hooks.add(hook, events)
+}
+
+// fireEvent notifies the server's hooks of a change made by the client. The
+// event's duration is measured from start.
+func (client *Client) fireEvent(kind, vpath, realPath string, size int64, start time.Time) {
+	client.server.hooks.dispatch(client.newEvent(kind, vpath, realPath, size, start))
+}
+
+func (client *Client) newEvent(kind, vpath, realPath string, size int64, start time.Time) Event {
+	now := time.Now()
+	host, _, err := net.SplitHostPort(client.ctrlConn.RemoteAddr().String())
+	if err != nil {
+		host = client.ctrlConn.RemoteAddr().String()
+	}
+
+	return Event{
+		Kind:       kind,
+		User:       client.username,
+		RemoteAddr: host,
+		Path:       vpath,
+		RealPath:   realPath,
+		Size:       size,
+		Duration:   now.Sub(start),
+		Time:       now,
+	}
+}
+
+// fireUploadEvent is like fireEvent, taking the size of the event from the
+// uploaded file.
+func (client *Client) fireUploadEvent(kind, paramPath, realPath string, start time.Time) {
+	var size int64
+	if stat, err := os.Stat(realPath); err == nil {
+		size = stat.Size()
+	}
+
+	client.fireEvent(kind, client.virtualPath(paramPath), realPath, size, start)
+}
@@ -0,0 +1,141 @@
+package charter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookHook(t *testing.T) {
+	events := make(chan Event, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&event))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		events <- event
+	}))
+	defer ts.Close()
+
+	d := newHookDispatcher(&Config{Hook: []HookConf{{URL: ts.URL, Events: []string{EventUpload}}}})
+	d.dispatch(Event{Kind: EventDelete, Path: "/ignored"})
+	d.dispatch(Event{Kind: EventUpload, User: "alice", Path: "/incoming/report.pdf", Size: 42})
+
+	select {
+	case event := <-events:
+		assert.Equal(t, EventUpload, event.Kind)
+		assert.Equal(t, "alice", event.User)
+		assert.Equal(t, "/incoming/report.pdf", event.Path)
+		assert.Equal(t, int64(42), event.Size)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook wasn't called")
+	}
+}
+
+func TestCommandHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "charter-hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	h := CommandHook{Path: "/bin/sh", Args: []string{"-c", `printf '%s %s %s' "$CHARTER_EVENT" "$CHARTER_OLD_PATH" "$CHARTER_PATH" > "$0"`, out}}
+	assert.Nil(t, h.Handle(Event{Kind: EventRename, OldPath: "/a.txt", Path: "/b.txt"}))
+
+	b, err := ioutil.ReadFile(out)
+	assert.Nil(t, err)
+	assert.Equal(t, "rename /a.txt /b.txt", string(b))
+}
+
+func TestHookRetry(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	done := make(chan struct{})
+	d := &hookDispatcher{queueSize: 1, retries: 2, backoff: time.Millisecond}
+	d.add(HookFunc(func(event Event) error {
+		defer func() {
+			if atomic.LoadInt32(&calls) == 3 {
+				close(done)
+			}
+		}()
+		return WebhookHook{URL: ts.URL}.Handle(event)
+	}), nil)
+	d.dispatch(Event{Kind: EventMkdir})
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("hook called %d times, want 3", atomic.LoadInt32(&calls))
+	}
+}
+
+func TestHookQueueFull(t *testing.T) {
+	block := make(chan struct{})
+	var handled int32
+	d := &hookDispatcher{queueSize: 1}
+	d.add(HookFunc(func(event Event) error {
+		<-block
+		atomic.AddInt32(&handled, 1)
+		return nil
+	}), nil)
+
+	// The first event is picked up by the runner and blocks it, the second fills
+	// the queue, and the rest are dropped.
+	for i := 0; i < 5; i++ {
+		d.dispatch(Event{Kind: EventUpload})
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(block)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&handled))
+}
+
+func TestHookTimeout(t *testing.T) {
+	start := time.Now()
+	h := CommandHook{Path: "/bin/sleep", Args: []string{"10"}, Timeout: 100 * time.Millisecond}
+	assert.NotNil(t, h.Handle(Event{Kind: EventUpload}))
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	start = time.Now()
+	wh := WebhookHook{URL: ts.URL, Timeout: 100 * time.Millisecond}
+	assert.NotNil(t, wh.Handle(Event{Kind: EventUpload}))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestHookTimeoutConfig(t *testing.T) {
+	d := newHookDispatcher(&Config{
+		HookTimeoutSeconds: 5,
+		Hook: []HookConf{
+			{Command: []string{"/bin/true"}},
+			{URL: "http://localhost/", TimeoutSeconds: 60},
+		},
+	})
+	if assert.Len(t, d.runners, 2) {
+		assert.Equal(t, 5*time.Second, d.runners[0].hook.(CommandHook).Timeout)
+		assert.Equal(t, time.Minute, d.runners[1].hook.(WebhookHook).Timeout)
+	}
+
+	assert.Equal(t, defaultHookTimeout, hookTimeout(0))
+}
@@ -0,0 +1,295 @@
+package charter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	janitorInterval = time.Hour
+
+	// defaultRetentionMaxActions is the number of files a retention rule may
+	// delete or archive in a single run, unless configured otherwise.
+	defaultRetentionMaxActions = 1000
+)
+
+// Actions taken by retention rules on expired files.
+const (
+	RetentionDelete  = "delete"
+	RetentionArchive = "archive"
+)
+
+// RetentionRule expires the regular files below the real directories matching
+// Path, a pattern as accepted by filepath.Glob, such as
+// "/srv/ftp/*/incoming". Files expire MaxAgeDays days after they were last
+// modified or, if AfterDownload is set, after they were last downloaded in full
+// with RETR. At least one of the two must be set.
+type RetentionRule struct {
+	Path          string
+	MaxAgeDays    int  `toml:"max-age-days"`
+	AfterDownload bool `toml:"after-download"`
+
+	// Action is either "delete", the default, or "archive", which moves
+	// expired files into ArchiveDir, below their full path on the host. The
+	// archive directory must be on the same filesystem.
+	Action     string
+	ArchiveDir string `toml:"archive-dir"`
+
+	// DryRun logs what the rule would do without doing it.
+	DryRun bool `toml:"dry-run"`
+
+	// MaxActions is the number of files the rule may expire in a single run,
+	// so that a mistaken rule can't wipe out a whole tree at once. If zero,
+	// the limit is 1000.
+	MaxActions int `toml:"max-actions"`
+}
+
+func (rule RetentionRule) validate() error {
+	switch {
+	case rule.Path == "":
+		return errors.New("path is empty")
+	case rule.MaxAgeDays <= 0 && !rule.AfterDownload:
+		return errors.New("neither max-age-days nor after-download is set")
+	case rule.Action == RetentionArchive && rule.ArchiveDir == "":
+		return errors.New("archive-dir is empty")
+	case rule.Action != "" && rule.Action != RetentionDelete && rule.Action != RetentionArchive:
+		return fmt.Errorf("unknown action %q", rule.Action)
+	}
+	return nil
+}
+
+// expired reports whether the file at p, described by fi, has expired under
+// the rule.
+func (srv *Server) expired(rule RetentionRule, p string, fi os.FileInfo, now time.Time) bool {
+	since := fi.ModTime()
+	if rule.AfterDownload {
+		downloaded, ok := srv.downloaded(p)
+		if !ok || downloaded.Before(since) {
+			return false
+		}
+		since = downloaded
+	}
+
+	return !now.Before(since.AddDate(0, 0, rule.MaxAgeDays))
+}
+
+// applyRetention applies a retention rule, logging every file it expires.
+func (srv *Server) applyRetention(rule RetentionRule, now time.Time) {
+	if err := rule.validate(); err != nil {
+		log.Printf("charter: retention rule for %s: %v", rule.Path, err)
+		return
+	}
+
+	roots, err := filepath.Glob(rule.Path)
+	if err != nil {
+		log.Printf("charter: retention rule for %s: %v", rule.Path, err)
+		return
+	}
+
+	maxActions := rule.MaxActions
+	if maxActions <= 0 {
+		maxActions = defaultRetentionMaxActions
+	}
+
+	actions := 0
+	for _, root := range roots {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		if root == filepath.Dir(root) {
+			log.Printf("charter: retention rule for %s: refusing to apply to %s", rule.Path, root)
+			return
+		}
+
+		// Symbolic links are never followed, and only regular files expire;
+		// directories are left in place, even once empty.
+		err = filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.Mode().IsRegular() || !srv.expired(rule, p, fi, now) {
+				return nil
+			}
+
+			if actions == maxActions {
+				return fmt.Errorf("stopping after %d files", maxActions)
+			}
+			actions++
+
+			if err := srv.expire(rule, root, p, fi); err != nil {
+				log.Printf("charter: retention: can't expire %s: %v", p, err)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("charter: retention rule for %s: %v", rule.Path, err)
+			return
+		}
+	}
+}
+
+// expire deletes or archives the expired file at p, found below root. The file
+// is reached without following links, since the tree may be changed by users
+// at any time.
+func (srv *Server) expire(rule RetentionRule, root, p string, fi os.FileInfo) error {
+	prefix := "charter: retention: "
+	if rule.DryRun {
+		prefix += "dry run: "
+	}
+
+	if rule.Action != RetentionArchive {
+		log.Printf("%sdeleting %s, modified %s", prefix, p, fi.ModTime().Format(time.RFC3339))
+		if rule.DryRun {
+			return nil
+		}
+		if err := removeBeneath(root, p); err != nil {
+			return err
+		}
+
+		srv.forgetDownload(p)
+		srv.quotasCovering(p).release(fi.Size(), 1)
+		return nil
+	}
+
+	dst, err := archivePath(rule.ArchiveDir, p)
+	if err != nil {
+		return err
+	}
+	log.Printf("%sarchiving %s to %s, modified %s", prefix, p, dst, fi.ModTime().Format(time.RFC3339))
+	if rule.DryRun {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := renameBeneath(root, p, "", dst); err != nil {
+		return err
+	}
+
+	srv.forgetDownload(p)
+	srv.quotasCovering(p).without(srv.quotasCovering(dst)).release(fi.Size(), 1)
+	return nil
+}
+
+// archivePath returns the path under which the file at p is archived in dir:
+// its full path below dir, with a number appended if that is already taken.
+func archivePath(dir, p string) (string, error) {
+	base := filepath.Join(dir, p)
+	for i := 0; i < maxUniqueAttempts; i++ {
+		dst := base
+		if i > 0 {
+			dst = fmt.Sprintf("%s.%d", base, i)
+		}
+		if _, err := os.Lstat(dst); os.IsNotExist(err) {
+			return dst, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	return "", os.ErrExist
+}
+
+// quotasCovering returns the quotas in use that cover the real path p.
+func (srv *Server) quotasCovering(p string) quotaSet {
+	srv.quotasMu.Lock()
+	defer srv.quotasMu.Unlock()
+
+	var qs quotaSet
+	for _, q := range srv.quotas {
+		if q.covers(p) {
+			qs = append(qs, q)
+		}
+	}
+	return qs
+}
+
+// tracksDownloads reports whether any retention rule depends on downloads, and
+// so whether they need recording.
+func (srv *Server) tracksDownloads() bool {
+	for _, rule := range srv.config.Retention {
+		if rule.AfterDownload {
+			return true
+		}
+	}
+	return false
+}
+
+// recordDownload records that the file at the real path p has been downloaded.
+// Downloads are only kept in memory, so files downloaded before a restart
+// aren't expired by after-download rules until downloaded again.
+func (srv *Server) recordDownload(p string) {
+	if !srv.tracksDownloads() {
+		return
+	}
+
+	srv.downloadsMu.Lock()
+	defer srv.downloadsMu.Unlock()
+	srv.downloads[p] = time.Now()
+}
+
+func (srv *Server) downloaded(p string) (time.Time, bool) {
+	srv.downloadsMu.Lock()
+	defer srv.downloadsMu.Unlock()
+	t, ok := srv.downloads[p]
+	return t, ok
+}
+
+func (srv *Server) forgetDownload(p string) {
+	srv.downloadsMu.Lock()
+	defer srv.downloadsMu.Unlock()
+	delete(srv.downloads, p)
+}
+
+// pruneDownloads forgets the downloads of files that no longer exist.
+func (srv *Server) pruneDownloads() {
+	srv.downloadsMu.Lock()
+	paths := make([]string, 0, len(srv.downloads))
+	for p := range srv.downloads {
+		paths = append(paths, p)
+	}
+	srv.downloadsMu.Unlock()
+
+	for _, p := range paths {
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			srv.forgetDownload(p)
+		}
+	}
+}
+
+// sweep runs the server's housekeeping once: purging the trash and applying
+// retention rules.
+func (srv *Server) sweep(now time.Time) {
+	if srv.config.TrashDir != "" && srv.config.TrashRetentionDays > 0 {
+		srv.purgeTrash(now)
+	}
+
+	for _, rule := range srv.config.Retention {
+		srv.applyRetention(rule, now)
+	}
+	srv.pruneDownloads()
+}
+
+// needsJanitor reports whether there is any housekeeping to do.
+func (srv *Server) needsJanitor() bool {
+	return (srv.config.TrashDir != "" && srv.config.TrashRetentionDays > 0) || len(srv.config.Retention) > 0
+}
+
+// janitor sweeps at the given interval until stop is closed.
+func (srv *Server) janitor(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	srv.sweep(time.Now())
+	for {
+		select {
+		case now := <-ticker.C:
+			srv.sweep(now)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package charter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeAged creates the file p, last modified the given number of days ago.
+func writeAged(t *testing.T, p string, days int) {
+	assert.Nil(t, os.MkdirAll(filepath.Dir(p), 0755))
+	assert.Nil(t, ioutil.WriteFile(p, []byte("data"), 0644))
+	mtime := time.Now().AddDate(0, 0, -days)
+	assert.Nil(t, os.Chtimes(p, mtime, mtime))
+}
+
+func exists(p string) bool {
+	_, err := os.Lstat(p)
+	return err == nil
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	root, err := ioutil.TempDir("", "charter-retention")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	for _, user := range []string{"alice", "bob"} {
+		writeAged(t, filepath.Join(root, user, "incoming/old.csv"), 40)
+		writeAged(t, filepath.Join(root, user, "incoming/sub/old.csv"), 40)
+		writeAged(t, filepath.Join(root, user, "incoming/new.csv"), 10)
+		writeAged(t, filepath.Join(root, user, "outgoing/old.csv"), 40)
+	}
+	assert.Nil(t, os.Symlink(filepath.Join(root, "alice/outgoing"), filepath.Join(root, "alice/incoming/link")))
+
+	rule := RetentionRule{Path: filepath.Join(root, "*/incoming"), MaxAgeDays: 30, DryRun: true}
+	srv := NewServer(&Config{Retention: []RetentionRule{
+		rule,
+		{Path: filepath.Join(root, "*/outgoing")},
+		{Path: filepath.Join(root, "*/outgoing"), MaxAgeDays: 30, Action: "shred"},
+	}})
+	srv.sweep(time.Now())
+	assert.True(t, exists(filepath.Join(root, "alice/incoming/old.csv")))
+	assert.True(t, exists(filepath.Join(root, "alice/outgoing/old.csv")))
+
+	rule.DryRun = false
+	rule.MaxActions = 3
+	srv.applyRetention(rule, time.Now())
+	assert.False(t, exists(filepath.Join(root, "alice/incoming/old.csv")))
+	assert.False(t, exists(filepath.Join(root, "alice/incoming/sub/old.csv")))
+	assert.False(t, exists(filepath.Join(root, "bob/incoming/old.csv")))
+	assert.True(t, exists(filepath.Join(root, "bob/incoming/sub/old.csv")))
+
+	srv.applyRetention(rule, time.Now())
+	assert.False(t, exists(filepath.Join(root, "bob/incoming/sub/old.csv")))
+	assert.True(t, exists(filepath.Join(root, "alice/incoming/new.csv")))
+	assert.True(t, exists(filepath.Join(root, "alice/incoming/link")))
+	assert.True(t, exists(filepath.Join(root, "alice/outgoing/old.csv")))
+}
+
+func TestRetentionAfterDownload(t *testing.T) {
+	archiveDir, err := ioutil.TempDir("", "charter-archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(archiveDir)
+
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.Retention = []RetentionRule{{
+			Path:          config.DefaultDir,
+			AfterDownload: true,
+			Action:        RetentionArchive,
+			ArchiveDir:    archiveDir,
+		}}
+	})
+	defer cleanup()
+
+	writeAged(t, filepath.Join(s.root, "report.csv"), 0)
+	writeAged(t, filepath.Join(s.root, "pending.csv"), 40)
+	s.expect("TYPE I", 200)
+	_, b := s.transfer("RETR report.csv", nil)
+	assert.Equal(t, "data", string(b))
+
+	s.srv.sweep(time.Now())
+	assert.False(t, exists(filepath.Join(s.root, "report.csv")))
+	assert.True(t, exists(filepath.Join(s.root, "pending.csv")))
+	assert.True(t, exists(filepath.Join(archiveDir, s.root, "report.csv")))
+	_, ok := s.srv.downloaded(filepath.Join(s.root, "report.csv"))
+	assert.False(t, ok)
+
+	// A file downloaded again after being replaced is archived alongside the
+	// earlier copy.
+	writeAged(t, filepath.Join(s.root, "report.csv"), 0)
+	s.transfer("RETR report.csv", nil)
+	s.srv.sweep(time.Now())
+	assert.True(t, exists(filepath.Join(archiveDir, s.root, "report.csv.1")))
+
+	// Files replaced since their download wait for the next download.
+	writeAged(t, filepath.Join(s.root, "report.csv"), 0)
+	s.srv.recordDownload(filepath.Join(s.root, "report.csv"))
+	writeAged(t, filepath.Join(s.root, "report.csv"), -1)
+	s.srv.sweep(time.Now())
+	assert.True(t, exists(filepath.Join(s.root, "report.csv")))
+}
@@ -0,0 +1,268 @@
+package charter
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Block mode descriptor codes. See RFC 959, section 3.4.2.
+const (
+	blockEOR     = 128
+	blockEOF     = 64
+	blockErrors  = 32
+	blockRestart = 16
+)
+
+const (
+	maxBlockSize = 0xFFFF
+
+	// restartInterval is the number of bytes sent in block mode between restart
+	// markers.
+	restartInterval = 1 << 20
+)
+
+// blockWriter encodes data in block mode. Data is sent in blocks of up to
+// maxBlockSize bytes, with a restart marker holding the byte offset of the data
+// sent so far every restartInterval bytes. Close sends the final, EOF block.
+type blockWriter struct {
+	w          *bufio.Writer
+	buf        []byte
+	sent       int64
+	nextMarker int64
+}
+
+func newBlockWriter(w io.Writer) *blockWriter {
+	return &blockWriter{
+		w:          bufio.NewWriter(w),
+		buf:        make([]byte, 0, maxBlockSize),
+		nextMarker: restartInterval,
+	}
+}
+
+func (bw *blockWriter) writeBlock(descriptor byte, data []byte) error {
+	var header [3]byte
+	header[0] = descriptor
+	binary.BigEndian.PutUint16(header[1:], uint16(len(data)))
+	if _, err := bw.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := bw.w.Write(data)
+	return err
+}
+
+// flush sends the buffered data as a block with the given descriptor, followed
+// by a restart marker if one is due.
+func (bw *blockWriter) flush(descriptor byte) error {
+	if err := bw.writeBlock(descriptor, bw.buf); err != nil {
+		return err
+	}
+	bw.sent += int64(len(bw.buf))
+	bw.buf = bw.buf[:0]
+
+	if bw.sent >= bw.nextMarker && descriptor&blockEOF == 0 {
+		marker := strconv.FormatInt(bw.sent, 10)
+		if err := bw.writeBlock(blockRestart, []byte(marker)); err != nil {
+			return err
+		}
+		bw.nextMarker = bw.sent + restartInterval
+	}
+	return nil
+}
+
+func (bw *blockWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		chunk := maxBlockSize - len(bw.buf)
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		bw.buf = append(bw.buf, p[:chunk]...)
+		p = p[chunk:]
+
+		if len(bw.buf) == maxBlockSize {
+			if err := bw.flush(0); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// EndRecord marks the end of a record, for transfers with record structure.
+func (bw *blockWriter) EndRecord() error {
+	return bw.flush(blockEOR)
+}
+
+func (bw *blockWriter) Close() error {
+	if err := bw.flush(blockEOF); err != nil {
+		return err
+	}
+	return bw.w.Flush()
+}
+
+// blockReader decodes data sent in block mode. Reads return io.EOF after the
+// block marked EOF, and io.ErrUnexpectedEOF if the connection closes before it
+// is seen, so that truncated uploads are detected.
+type blockReader struct {
+	r         *bufio.Reader
+	remaining int
+	desc      byte
+	eof       bool
+
+	// onMarker, if set, is called for each restart marker received, with the
+	// number of data bytes received before it.
+	onMarker func(marker string, received int64)
+	received int64
+
+	// If records is set, the end of each record is passed on as a newline, for
+	// transfers with record structure.
+	records   bool
+	endRecord bool
+}
+
+func newBlockReader(r io.Reader) *blockReader {
+	return &blockReader{r: bufio.NewReader(r)}
+}
+
+// next finishes the current block and reads the header of the next one. The
+// data of restart marker blocks is consumed, leaving nothing to read.
+func (br *blockReader) next() error {
+	if br.eof {
+		return io.EOF
+	}
+	if br.desc&blockEOF != 0 {
+		br.eof = true
+		return io.EOF
+	}
+
+	var header [3]byte
+	if _, err := io.ReadFull(br.r, header[:]); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	br.desc = header[0]
+	br.remaining = int(binary.BigEndian.Uint16(header[1:]))
+	br.endRecord = br.records && br.desc&blockEOR != 0
+
+	if br.desc&blockRestart != 0 {
+		marker := make([]byte, br.remaining)
+		if _, err := io.ReadFull(br.r, marker); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		br.remaining = 0
+		if br.onMarker != nil {
+			br.onMarker(string(marker), br.received)
+		}
+	}
+	return nil
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	for br.remaining == 0 {
+		if br.endRecord && len(p) > 0 {
+			br.endRecord = false
+			p[0] = '\n'
+			return 1, nil
+		}
+		if err := br.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(p) > br.remaining {
+		p = p[:br.remaining]
+	}
+	n, err := br.r.Read(p)
+	br.remaining -= n
+	br.received += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nopWriteCloser adds a no-op Close method to a writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// dataWriter returns a writer that encodes data sent on the data connection in
+// the session's transmission mode. Closing it finishes the transfer, but
+// doesn't close the connection.
+func (client *Client) dataWriter() io.WriteCloser {
+	switch client.mode {
+	case ModeBlock:
+		return newBlockWriter(client.dataConn)
+	case ModeDeflate:
+		zw, err := zlib.NewWriterLevel(client.dataConn, client.deflateLevel)
+		if err != nil {
+			zw = zlib.NewWriter(client.dataConn)
+		}
+		return zw
+	}
+
+	return nopWriteCloser{client.dataConn}
+}
+
+// dataReader returns a reader that decodes data received on the data
+// connection in the session's transmission mode and file structure.
+func (client *Client) dataReader() (io.Reader, error) {
+	records := client.structure == StructureRecord
+
+	var r io.Reader = client.dataConn
+	switch client.mode {
+	case ModeBlock:
+		br := newBlockReader(client.dataConn)
+		br.onMarker = func(marker string, received int64) {
+			_ = client.sendReply(110, "MARK %s = %d", marker, received)
+		}
+		br.records = records
+		return br, nil
+	case ModeDeflate:
+		zr, err := zlib.NewReader(client.dataConn)
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	}
+
+	if records {
+		return &streamRecordReader{r: bufio.NewReader(r)}, nil
+	}
+	return r, nil
+}
+
+func modeZFeature(client *Client) string {
+	return "MODE Z"
+}
+
+// modeOptsHandler handles OPTS MODE Z LEVEL n, which sets the compression level
+// used in MODE Z.
+func modeOptsHandler(client *Client, command FtpCommand) (isExiting bool) {
+	fields := strings.Fields(strings.ToUpper(command.Arg))
+	if len(fields) != 3 || fields[0] != "Z" || fields[1] != "LEVEL" {
+		_ = client.sendReply(501, "Option not understood for MODE")
+		return
+	}
+
+	level, err := strconv.Atoi(fields[2])
+	if err != nil || level < zlib.BestSpeed || level > zlib.BestCompression {
+		_ = client.sendReply(501, "Invalid compression level %s", fields[2])
+		return
+	}
+
+	client.deflateLevel = level
+	_ = client.sendReply(200, "MODE Z LEVEL set to %d", level)
+	return
+}
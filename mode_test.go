@@ -0,0 +1,73 @@
+package charter
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockModeRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), (restartInterval+maxBlockSize)/16)
+
+	var encoded bytes.Buffer
+	bw := newBlockWriter(&encoded)
+	_, err := bw.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, bw.Close())
+
+	var markers []string
+	br := newBlockReader(&encoded)
+	br.onMarker = func(marker string, received int64) {
+		markers = append(markers, marker)
+		assert.Equal(t, marker, strconv.FormatInt(received, 10))
+	}
+
+	decoded, err := ioutil.ReadAll(br)
+	assert.Nil(t, err)
+	assert.Equal(t, data, decoded)
+	assert.Len(t, markers, 1)
+}
+
+func TestBlockModeTruncated(t *testing.T) {
+	var encoded bytes.Buffer
+	bw := newBlockWriter(&encoded)
+	_, _ = bw.Write([]byte("hello"))
+	_ = bw.EndRecord()
+
+	_, err := ioutil.ReadAll(newBlockReader(&encoded))
+	assert.Equal(t, "unexpected EOF", err.Error())
+}
+
+func TestDeflateMode(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	content := bytes.Repeat([]byte("compressible "), 1000)
+	assert.Nil(t, ioutil.WriteFile(s.root+"/big.txt", content, 0644))
+
+	s.expect("TYPE I", 200)
+	s.expect("MODE Z", 200)
+	s.expect("OPTS MODE Z LEVEL 9", 200)
+	s.expect("OPTS MODE Z LEVEL 10", 501)
+
+	_, data := s.transfer("RETR big.txt", nil)
+	assert.True(t, len(data) < len(content))
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	assert.Nil(t, err)
+	decoded, err := ioutil.ReadAll(zr)
+	assert.Nil(t, err)
+	assert.Equal(t, content, decoded)
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	_, _ = zw.Write(content)
+	_ = zw.Close()
+	s.transfer("STOR copy.txt", compressed.Bytes())
+	stored, err := ioutil.ReadFile(s.root + "/copy.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, content, stored)
+}
@@ -0,0 +1,158 @@
+package charter
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrReadOnly   = errors.New("read-only file system")
+	ErrMountPoint = errors.New("operation not permitted on a mount point")
+)
+
+// validUsername reports whether name can safely stand for $USER in a mount
+// source, and so name per-user files and directories: it must be a single,
+// ordinary path component.
+func validUsername(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// mount maps a virtual directory in the client's namespace onto a real
+// directory on the host.
+type mount struct {
+	path     string // Absolute virtual path of the mount point.
+	source   string // Real directory mounted at path.
+	readOnly bool
+	quota    QuotaConf
+}
+
+// mountTable is the set of mounts making up a client's namespace, ordered so
+// that deeper mount points come first.
+type mountTable []mount
+
+// newMountTable builds the namespace for the given user from the server
+// configuration. Occurrences of $USER in mount sources are replaced with the
+// user's name, which must have been checked with validUsername. If no mounts
+// are configured, the default directory is mounted at the root. Sources are
+// cleaned, so that real paths can be compared against them with within.
+func newMountTable(config *Config, user string) mountTable {
+	if len(config.Mount) == 0 {
+		return mountTable{{path: "/", source: filepath.Clean(config.DefaultDir)}}
+	}
+
+	mt := make(mountTable, 0, len(config.Mount))
+	for _, conf := range config.Mount {
+		mt = append(mt, mount{
+			path:     path.Clean("/" + conf.Path),
+			source:   filepath.Clean(strings.Replace(conf.Source, "$USER", user, -1)),
+			readOnly: conf.ReadOnly,
+			quota:    conf.Quota,
+		})
+	}
+
+	sort.SliceStable(mt, func(i, j int) bool {
+		return len(mt[i].path) > len(mt[j].path)
+	})
+
+	return mt
+}
+
+// within reports whether the clean path p is dir or lies below it.
+func within(p, dir string) bool {
+	if p == dir {
+		return true
+	}
+	if !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir += string(filepath.Separator)
+	}
+	return strings.HasPrefix(p, dir)
+}
+
+// lookup returns the mount containing the clean, absolute virtual path vpath,
+// along with the remainder of the path below the mount point. If vpath isn't
+// covered by any mount, lookup returns nil.
+func (mt mountTable) lookup(vpath string) (*mount, string) {
+	for i := range mt {
+		m := &mt[i]
+		if m.path == "/" {
+			return m, vpath
+		}
+		if vpath == m.path {
+			return m, "/"
+		}
+		if strings.HasPrefix(vpath, m.path+"/") {
+			return m, strings.TrimPrefix(vpath, m.path)
+		}
+	}
+
+	return nil, ""
+}
+
+// isVirtualDir reports whether vpath is a directory that exists only because
+// some mount point lies beneath it.
+func (mt mountTable) isVirtualDir(vpath string) bool {
+	if vpath == "/" {
+		return true
+	}
+
+	for _, m := range mt {
+		if strings.HasPrefix(m.path, vpath+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// children returns the names of the mount points and synthesised directories
+// directly beneath vpath.
+func (mt mountTable) children(vpath string) []string {
+	prefix := vpath
+	if prefix != "/" {
+		prefix += "/"
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, m := range mt {
+		if m.path == "/" || !strings.HasPrefix(m.path, prefix) {
+			continue
+		}
+
+		name := strings.SplitN(strings.TrimPrefix(m.path, prefix), "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// virtualDirInfo describes a directory synthesised from the mount table.
+type virtualDirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (fi virtualDirInfo) Name() string       { return fi.name }
+func (fi virtualDirInfo) Size() int64        { return 0 }
+func (fi virtualDirInfo) Mode() os.FileMode  { return os.ModeDir | 0555 }
+func (fi virtualDirInfo) ModTime() time.Time { return fi.modTime }
+func (fi virtualDirInfo) IsDir() bool        { return true }
+func (fi virtualDirInfo) Sys() interface{}   { return nil }
+
+// renamedInfo presents a mount point's source directory under the name of the
+// mount point.
+type renamedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi renamedInfo) Name() string { return fi.name }
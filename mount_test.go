@@ -0,0 +1,110 @@
+package charter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountTableLookup(t *testing.T) {
+	mt := newMountTable(&Config{
+		Mount: []MountConf{
+			{Path: "/incoming", Source: "/srv/drop/$USER"},
+			{Path: "/releases", Source: "/srv/releases", ReadOnly: true},
+			{Path: "/releases/beta", Source: "/srv/beta"},
+		},
+	}, "alice")
+
+	tests := []struct {
+		path   string
+		source string
+		rest   string
+	}{
+		{path: "/incoming", source: "/srv/drop/alice", rest: "/"},
+		{path: "/incoming/a/b", source: "/srv/drop/alice", rest: "/a/b"},
+		{path: "/releases/v1", source: "/srv/releases", rest: "/v1"},
+		{path: "/releases/beta/v2", source: "/srv/beta", rest: "/v2"},
+		{path: "/releases/betamax", source: "/srv/releases", rest: "/betamax"},
+	}
+
+	for _, tt := range tests {
+		m, rest := mt.lookup(tt.path)
+		if assert.NotNil(t, m, tt.path) {
+			assert.Equal(t, tt.source, m.source, tt.path)
+			assert.Equal(t, tt.rest, rest, tt.path)
+		}
+	}
+
+	m, _ := mt.lookup("/")
+	assert.Nil(t, m)
+	m, _ = mt.lookup("/shared")
+	assert.Nil(t, m)
+}
+
+func TestMountTableVirtualDirs(t *testing.T) {
+	mt := newMountTable(&Config{
+		Mount: []MountConf{
+			{Path: "/a/b/c", Source: "/srv/c"},
+			{Path: "/a/d", Source: "/srv/d"},
+			{Path: "/e", Source: "/srv/e"},
+		},
+	}, "alice")
+
+	assert.True(t, mt.isVirtualDir("/"))
+	assert.True(t, mt.isVirtualDir("/a"))
+	assert.True(t, mt.isVirtualDir("/a/b"))
+	assert.False(t, mt.isVirtualDir("/a/b/c"))
+	assert.False(t, mt.isVirtualDir("/e"))
+
+	assert.Equal(t, []string{"a", "e"}, mt.children("/"))
+	assert.Equal(t, []string{"b", "d"}, mt.children("/a"))
+	assert.Nil(t, mt.children("/e"))
+}
+
+func TestMountTableDefault(t *testing.T) {
+	mt := newMountTable(&Config{DefaultDir: "/home/alice"}, "alice")
+
+	m, rest := mt.lookup("/docs")
+	if assert.NotNil(t, m) {
+		assert.Equal(t, "/home/alice", m.source)
+		assert.Equal(t, "/docs", rest)
+	}
+	assert.Nil(t, mt.children("/"))
+}
+
+func TestMountTableCleansSources(t *testing.T) {
+	mt := newMountTable(&Config{DefaultDir: "/home/alice/"}, "alice")
+	assert.Equal(t, "/home/alice", mt[0].source)
+
+	mt = newMountTable(&Config{
+		Mount: []MountConf{
+			{Path: "/incoming", Source: "/srv/drop/$USER/"},
+			{Path: "/all", Source: "//"},
+		},
+	}, "alice")
+	m, _ := mt.lookup("/incoming/x")
+	if assert.NotNil(t, m) {
+		assert.Equal(t, "/srv/drop/alice", m.source)
+	}
+	m, _ = mt.lookup("/all/x")
+	if assert.NotNil(t, m) {
+		assert.Equal(t, "/", m.source)
+	}
+}
+
+func TestWithin(t *testing.T) {
+	assert.True(t, within("/srv/drop", "/srv/drop"))
+	assert.True(t, within("/srv/drop/a", "/srv/drop"))
+	assert.False(t, within("/srv/dropbox", "/srv/drop"))
+	assert.True(t, within("/srv/drop", "/"))
+	assert.True(t, within("/", "/"))
+}
+
+func TestValidUsername(t *testing.T) {
+	for _, name := range []string{"alice", "a.b", "...", "alice smith"} {
+		assert.True(t, validUsername(name), name)
+	}
+	for _, name := range []string{"", ".", "..", "../alice", "a/b", `a\b`, "a\x00b"} {
+		assert.False(t, validUsername(name), name)
+	}
+}
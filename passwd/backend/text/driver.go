@@ -120,13 +120,20 @@ func (c *connector) GetPassword(user string) (string, error) {
 // CheckUserPassword verifies that the specified password matches that of the
 // user. Returns true if the password is correct, false if not.
 func (c *connector) CheckUserPassword(user string, pass string) error {
-	guessHash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	info, ok := c.userInfo[user]
+	if !ok {
+		return passwd.ErrNotExist
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(info.pass)
 	if err != nil {
 		return err
 	}
 
-	if base64.StdEncoding.EncodeToString(guessHash) != c.userInfo[user].pass {
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(pass)); err == bcrypt.ErrMismatchedHashAndPassword {
 		return passwd.ErrIncorrectPassword
+	} else if err != nil {
+		return err
 	}
 
 	return nil
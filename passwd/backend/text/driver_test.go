@@ -1,14 +1,17 @@
 package text
 
 import (
+	"encoding/base64"
 	"strings"
 	"testing"
 
+	"github.com/maybetheresloop/charter-go/passwd"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestOpenReader(t *testing.T) {
-	text := "user1,passwd1\nuser2,passwd2\nuser3,passwd3\n"
+	text := "user1:passwd1\nuser2:passwd2\nuser3:passwd3\n"
 
 	c, err := readUsers(strings.NewReader(text))
 	assert.Nil(t, err)
@@ -23,7 +26,7 @@ func TestOpenReader(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		assert.Contains(t, c, tt.user)
+		assert.Contains(t, c.users, tt.user)
 		pass, err := c.GetPassword(tt.user)
 		assert.Nil(t, err)
 		assert.Equal(t, tt.pass, pass)
@@ -46,3 +49,15 @@ func TestOpenReaderEmpty(t *testing.T) {
 	assert.Len(t, c.users, 0)
 	assert.Len(t, c.userInfo, 0)
 }
+
+func TestCheckUserPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.Nil(t, err)
+
+	c, err := readUsers(strings.NewReader("alice:" + base64.StdEncoding.EncodeToString(hash) + "\n"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, c.CheckUserPassword("alice", "secret"))
+	assert.Equal(t, passwd.ErrIncorrectPassword, c.CheckUserPassword("alice", "wrong"))
+	assert.Equal(t, passwd.ErrNotExist, c.CheckUserPassword("bob", "secret"))
+}
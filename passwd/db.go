@@ -8,7 +8,7 @@ import (
 type unknownDriverError string
 
 func (err unknownDriverError) Error() string {
-	return fmt.Sprintf("unknown driver: %s", err)
+	return fmt.Sprintf("unknown driver: %s", string(err))
 }
 
 func errUnknownDriver(driverName string) error {
@@ -48,6 +48,11 @@ func (db *DB) GetPassword(user string) (string, error) {
 	return db.connector.GetPassword(user)
 }
 
+// CheckUserPassword verifies that pass is the password of user.
+func (db *DB) CheckUserPassword(user string, pass string) error {
+	return db.connector.CheckUserPassword(user, pass)
+}
+
 func (db *DB) UserAdd(user string, pass string) error {
 	return nil
 }
@@ -0,0 +1,294 @@
+package charter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrQuotaExceeded = errors.New("exceeded storage allocation")
+
+// QuotaConf limits the number of bytes and files stored in a tree. A limit of
+// zero means unlimited.
+type QuotaConf struct {
+	Bytes int64
+	Files int64
+}
+
+func (conf QuotaConf) isSet() bool {
+	return conf.Bytes > 0 || conf.Files > 0
+}
+
+// quota tracks the usage of a set of real directory trees against a limit.
+// Usage is computed by walking the trees the first time the quota is needed,
+// and is then kept up to date incrementally as files are written and removed.
+type quota struct {
+	name  string
+	limit QuotaConf
+	roots []string
+
+	mu      sync.Mutex
+	scanned bool
+	bytes   int64
+	files   int64
+}
+
+// covers reports whether the real path p lies inside one of the quota's trees.
+func (q *quota) covers(p string) bool {
+	for _, root := range q.roots {
+		if within(p, root) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scan recomputes the quota's usage by walking its trees. Symbolic links are
+// not followed.
+func (q *quota) scan() error {
+	var bytes, files int64
+	for _, root := range q.roots {
+		b, f, err := treeUsage(root)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		bytes += b
+		files += f
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.bytes, q.files, q.scanned = bytes, files, true
+	return nil
+}
+
+// ensureScanned computes the quota's usage if it hasn't been computed yet.
+func (q *quota) ensureScanned() error {
+	q.mu.Lock()
+	scanned := q.scanned
+	q.mu.Unlock()
+
+	if scanned {
+		return nil
+	}
+	return q.scan()
+}
+
+// reserve charges the given number of bytes and files against the quota,
+// failing without charging anything if the limit would be exceeded.
+func (q *quota) reserve(bytes, files int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.limit.Bytes > 0 && bytes > 0 && q.bytes+bytes > q.limit.Bytes {
+		return ErrQuotaExceeded
+	}
+	if q.limit.Files > 0 && files > 0 && q.files+files > q.limit.Files {
+		return ErrQuotaExceeded
+	}
+
+	q.bytes += bytes
+	q.files += files
+	return nil
+}
+
+// release returns the given number of bytes and files to the quota.
+func (q *quota) release(bytes, files int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.bytes -= bytes
+	q.files -= files
+	if q.bytes < 0 {
+		q.bytes = 0
+	}
+	if q.files < 0 {
+		q.files = 0
+	}
+}
+
+func (q *quota) String() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return fmt.Sprintf("%s: %s bytes, %s files", q.name,
+		usageString(q.bytes, q.limit.Bytes), usageString(q.files, q.limit.Files))
+}
+
+func usageString(used, limit int64) string {
+	if limit <= 0 {
+		return fmt.Sprintf("%d of unlimited", used)
+	}
+	return fmt.Sprintf("%d of %d", used, limit)
+}
+
+// quotaSet is the set of quotas applying to a single write.
+type quotaSet []*quota
+
+// reserve charges bytes and files against every quota in the set. If any
+// quota would be exceeded, nothing is charged.
+func (qs quotaSet) reserve(bytes, files int64) error {
+	for i, q := range qs {
+		if err := q.reserve(bytes, files); err != nil {
+			for _, reserved := range qs[:i] {
+				reserved.release(bytes, files)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (qs quotaSet) release(bytes, files int64) {
+	for _, q := range qs {
+		q.release(bytes, files)
+	}
+}
+
+// without returns the quotas in qs that aren't in other.
+func (qs quotaSet) without(other quotaSet) quotaSet {
+	var diff quotaSet
+	for _, q := range qs {
+		found := false
+		for _, o := range other {
+			if q == o {
+				found = true
+				break
+			}
+		}
+		if !found {
+			diff = append(diff, q)
+		}
+	}
+
+	return diff
+}
+
+// treeUsage returns the number of bytes and regular files in the tree rooted at
+// p, which may also be a single file. Symbolic links are not followed.
+func treeUsage(p string) (int64, int64, error) {
+	var bytes, files int64
+	err := filepath.Walk(p, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode().IsRegular() {
+			bytes += fi.Size()
+			files++
+		}
+		return nil
+	})
+
+	return bytes, files, err
+}
+
+// quotaWriter charges everything written through it against a set of quotas,
+// failing with ErrQuotaExceeded once the allocation is used up.
+type quotaWriter struct {
+	w      io.Writer
+	quotas quotaSet
+}
+
+func (qw *quotaWriter) Write(p []byte) (int, error) {
+	if err := qw.quotas.reserve(int64(len(p)), 0); err != nil {
+		return 0, err
+	}
+
+	n, err := qw.w.Write(p)
+	if n < len(p) {
+		qw.quotas.release(int64(len(p)-n), 0)
+	}
+	return n, err
+}
+
+// quotasFor returns the quotas applying to the given user and mount table,
+// creating and scanning them as needed. Quotas are shared between sessions, so
+// that concurrent logins of the same user draw from the same allocation.
+func (srv *Server) quotasFor(user string, mounts mountTable) []*quota {
+	srv.quotasMu.Lock()
+	defer srv.quotasMu.Unlock()
+
+	var quotas []*quota
+	if conf := srv.config.Users[user].Quota; conf.isSet() {
+		var roots []string
+		for _, m := range mounts {
+			if !m.readOnly {
+				roots = append(roots, m.source)
+			}
+		}
+		quotas = append(quotas, srv.quota("user "+user, conf, roots))
+	}
+
+	for _, m := range mounts {
+		if m.quota.isSet() && !m.readOnly {
+			quotas = append(quotas, srv.quota("mount "+m.path, m.quota, []string{m.source}))
+		}
+	}
+
+	for _, q := range quotas {
+		_ = q.ensureScanned()
+	}
+	return quotas
+}
+
+// quota returns the shared quota with the given name, creating it if needed.
+// Callers must hold quotasMu.
+func (srv *Server) quota(name string, limit QuotaConf, roots []string) *quota {
+	sort.Strings(roots)
+	key := name + "\x00" + strings.Join(roots, "\x00")
+	if q, ok := srv.quotas[key]; ok {
+		return q
+	}
+
+	q := &quota{
+		name:  name,
+		limit: limit,
+		roots: roots,
+	}
+	srv.quotas[key] = q
+	return q
+}
+
+// quotasFor returns the client's quotas that cover the real path p.
+func (client *Client) quotasFor(p string) quotaSet {
+	var qs quotaSet
+	for _, q := range client.quotas {
+		if q.covers(p) {
+			qs = append(qs, q)
+		}
+	}
+
+	return qs
+}
+
+func siteQuotaHandler(client *Client, command FtpCommand) (isExiting bool) {
+	if len(command.Params) > 0 && strings.ToUpper(command.Params[0]) == "RESCAN" {
+		for _, q := range client.quotas {
+			if err := q.scan(); err != nil {
+				_ = client.sendReply(550, "Can't compute usage for %s: %v", q.name, pathErr(err))
+				return
+			}
+		}
+	}
+
+	if len(client.quotas) == 0 {
+		_ = client.sendReply(200, "No quotas apply to you")
+		return
+	}
+
+	lines := []string{"Quotas for " + client.username + ":"}
+	for _, q := range client.quotas {
+		lines = append(lines, " "+q.String())
+	}
+	lines = append(lines, "End")
+	_ = client.sendReply(200, "%s", strings.Join(lines, "\n"))
+	return
+}
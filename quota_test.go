@@ -0,0 +1,68 @@
+package charter
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaReserve(t *testing.T) {
+	q := &quota{limit: QuotaConf{Bytes: 10, Files: 2}, scanned: true}
+
+	assert.Nil(t, q.reserve(4, 1))
+	assert.Nil(t, q.reserve(6, 1))
+	assert.Equal(t, ErrQuotaExceeded, q.reserve(1, 0))
+	assert.Equal(t, ErrQuotaExceeded, q.reserve(0, 1))
+
+	q.release(5, 1)
+	assert.Nil(t, q.reserve(5, 1))
+	assert.Equal(t, int64(10), q.bytes)
+	assert.Equal(t, int64(2), q.files)
+}
+
+func TestQuotaCovers(t *testing.T) {
+	q := &quota{roots: []string{"/srv/drop"}}
+	assert.True(t, q.covers("/srv/drop"))
+	assert.True(t, q.covers("/srv/drop/a/b"))
+	assert.False(t, q.covers("/srv/dropbox"))
+
+	q = &quota{roots: []string{"/"}}
+	assert.True(t, q.covers("/"))
+	assert.True(t, q.covers("/srv/drop"))
+}
+
+func TestQuotaTrailingSlashSource(t *testing.T) {
+	s, done := newTestSession(t, func(config *Config) {
+		config.DefaultDir += "/"
+		config.Users = map[string]UserConf{"alice": {Quota: QuotaConf{Bytes: 4}}}
+	})
+	defer done()
+
+	_, code, _ := s.tryTransfer("STOR big.txt", bytes.Repeat([]byte("x"), 100))
+	assert.Equal(t, 552, code)
+	s.transfer("STOR small.txt", []byte("abc"))
+}
+
+func TestQuotaSetRollback(t *testing.T) {
+	loose := &quota{limit: QuotaConf{Bytes: 100}}
+	tight := &quota{limit: QuotaConf{Bytes: 5}}
+	qs := quotaSet{loose, tight}
+
+	assert.Equal(t, ErrQuotaExceeded, qs.reserve(6, 0))
+	assert.Equal(t, int64(0), loose.bytes)
+	assert.Equal(t, int64(0), tight.bytes)
+}
+
+func TestQuotaWriter(t *testing.T) {
+	q := &quota{limit: QuotaConf{Bytes: 8}}
+	var buf bytes.Buffer
+	w := &quotaWriter{w: &buf, quotas: quotaSet{q}}
+
+	_, err := w.Write([]byte("hello"))
+	assert.Nil(t, err)
+	_, err = w.Write([]byte("world"))
+	assert.Equal(t, ErrQuotaExceeded, err)
+	assert.Equal(t, "hello", buf.String())
+	assert.Equal(t, int64(5), q.bytes)
+}
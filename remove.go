@@ -0,0 +1,150 @@
+package charter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxRemoveFailures is the number of failures listed in the reply to a
+// recursive removal. Any further failures are only counted.
+const maxRemoveFailures = 50
+
+var ErrRecursiveDeleteDisabled = errors.New("recursive deletion is disabled")
+
+// removeTree removes the directory realDir, known to the client as vdir, and
+// everything in it. Symbolic links are removed rather than followed, so the
+// walk never leaves the tree. Entries that can't be removed are skipped, and
+// described in the returned failures; the number of bytes removed is also
+// returned.
+func (client *Client) removeTree(realDir, vdir string) (removed int64, failures []string) {
+	var entries []string
+	failed := make(map[string]bool)
+	fail := func(p string, err error) {
+		rel, _ := filepath.Rel(realDir, p)
+		failures = append(failures, fmt.Sprintf("%s: %v", path.Join(vdir, filepath.ToSlash(rel)), pathErr(err)))
+
+		// A directory can't be removed once something in it couldn't be, and
+		// there is no need to report it again.
+		for dir := filepath.Dir(p); strings.HasPrefix(dir, realDir); dir = filepath.Dir(dir) {
+			failed[dir] = true
+			if dir == realDir {
+				break
+			}
+		}
+	}
+
+	_ = filepath.Walk(realDir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			fail(p, err)
+			if fi != nil && fi.IsDir() {
+				failed[p] = true
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		entries = append(entries, p)
+		return nil
+	})
+
+	// Walk visits directories before their contents, so removing in reverse
+	// order empties each directory before it is removed.
+	for i := len(entries) - 1; i >= 0; i-- {
+		p := entries[i]
+		if failed[p] {
+			continue
+		}
+
+		fi, err := os.Lstat(p)
+		if err == nil {
+			if fi.IsDir() {
+				err = removeBeneath(client.rootOf(p), p)
+			} else {
+				err = client.removeFile(p)
+			}
+		}
+		if err != nil {
+			fail(p, err)
+			continue
+		}
+		if fi.Mode().IsRegular() {
+			removed += fi.Size()
+		}
+	}
+
+	return removed, failures
+}
+
+// removeDirAll handles recursive removal for RMDA and SITE RMDIR -r.
+func removeDirAll(client *Client, paramDir string) {
+	start := time.Now()
+	if !client.server.config.RecursiveDelete {
+		_ = client.sendReply(550, "Can't remove directory: %v", ErrRecursiveDeleteDisabled)
+		return
+	}
+
+	realDir, err := client.writableLinkPath(paramDir)
+	if err != nil {
+		_ = client.sendReply(550, "Can't remove directory: %v", err)
+		return
+	}
+
+	stat, err := os.Lstat(realDir)
+	if err != nil {
+		_ = client.sendReply(550, "Can't remove directory: %v", pathErr(err))
+		return
+	} else if !stat.IsDir() {
+		_ = client.sendReply(550, "Can't remove directory: %v", ErrNotDir)
+		return
+	}
+
+	vdir := client.virtualPath(paramDir)
+	if _, ok := client.server.trashFor(client.username); ok {
+		bytes, _, _ := treeUsage(realDir)
+		if err := client.moveToTrash(realDir, vdir); err != nil {
+			_ = client.sendReply(550, "Can't remove directory: %v", pathErr(err))
+			return
+		}
+		_ = client.sendReply(250, "The directory was successfully removed")
+		client.fireEvent(EventRmdir, vdir, realDir, bytes, start)
+		return
+	}
+
+	removed, failures := client.removeTree(realDir, vdir)
+	if len(failures) == 0 {
+		_ = client.sendReply(250, "The directory was successfully removed")
+		client.fireEvent(EventRmdir, vdir, realDir, removed, start)
+		return
+	}
+
+	if len(failures) > maxRemoveFailures {
+		more := len(failures) - maxRemoveFailures
+		failures = append(failures[:maxRemoveFailures], fmt.Sprintf("... and %d more", more))
+	}
+	_ = client.sendMultilineReply(550, "Some entries couldn't be removed:", failures, "End")
+}
+
+func rmdaHandler(client *Client, command FtpCommand) (isExiting bool) {
+	removeDirAll(client, command.Arg)
+	return
+}
+
+// siteRmdirHandler handles SITE RMDIR [-r] path. Without -r, it behaves like
+// RMD.
+func siteRmdirHandler(client *Client, command FtpCommand) (isExiting bool) {
+	opts, pathname := splitListArg(command.Arg)
+	if pathname == "" {
+		_ = client.sendReply(501, "Missing pathname")
+		return
+	}
+	if strings.ContainsAny(opts, "rR") {
+		removeDirAll(client, pathname)
+		return
+	}
+
+	return rmdHandler(client, FtpCommand{Command: "RMD", Arg: pathname})
+}
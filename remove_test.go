@@ -0,0 +1,71 @@
+package charter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTree(t *testing.T, root string) {
+	for _, dir := range []string{"project/src/pkg", "project/docs"} {
+		assert.Nil(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	for _, file := range []string{"project/README", "project/src/main.go", "project/src/pkg/lib.go"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(root, file), []byte("data"), 0644))
+	}
+}
+
+func TestRmda(t *testing.T) {
+	outside, err := ioutil.TempDir("", "charter-outside")
+	assert.Nil(t, err)
+	defer os.RemoveAll(outside)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(outside, "keep"), []byte("data"), 0644))
+
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.RecursiveDelete = true
+	})
+	defer cleanup()
+
+	makeTree(t, s.root)
+	assert.Nil(t, os.Symlink(outside, filepath.Join(s.root, "project/docs/outside")))
+
+	s.expect("RMD project", 550)
+	s.expect("RMDA project/README", 550)
+	s.expect("RMDA project", 250)
+	_, err = os.Stat(filepath.Join(s.root, "project"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(outside, "keep"))
+	assert.Nil(t, err)
+
+	makeTree(t, s.root)
+	s.expect("SITE RMDIR project", 550)
+	s.expect("SITE RMDIR -r project", 250)
+	_, err = os.Stat(filepath.Join(s.root, "project"))
+	assert.True(t, os.IsNotExist(err))
+
+	if os.Geteuid() != 0 {
+		makeTree(t, s.root)
+		locked := filepath.Join(s.root, "project/src/pkg")
+		assert.Nil(t, os.Chmod(locked, 0555))
+		defer os.Chmod(locked, 0755)
+
+		msg := s.expect("RMDA project", 550)
+		assert.Contains(t, msg, "/project/src/pkg/lib.go: permission denied")
+		assert.NotContains(t, msg, "/project/src:")
+		_, err = os.Stat(filepath.Join(s.root, "project/README"))
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestRmdaDisabled(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	makeTree(t, s.root)
+	s.expect("RMDA project", 550)
+	_, err := os.Stat(filepath.Join(s.root, "project/README"))
+	assert.Nil(t, err)
+}
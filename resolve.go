@@ -0,0 +1,203 @@
+package charter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxSymlinks is the maximum number of symbolic links followed while resolving
+// a single path, mirroring the kernel's ELOOP limit.
+const maxSymlinks = 40
+
+var (
+	ErrPathEscapesRoot    = errors.New("path escapes root directory")
+	ErrSymlinkNotAllowed  = errors.New("symbolic links are not allowed")
+	ErrTooManySymlinks    = errors.New("too many levels of symbolic links")
+	ErrInvalidSymlinkPath = errors.New("invalid symbolic link target")
+)
+
+// resolver maps virtual paths onto a real directory tree without ever leaving
+// it. Unlike a plain filepath.Join, it walks the path one component at a time
+// so that symbolic links inside the tree can't be used to reach the rest of the
+// host filesystem.
+type resolver struct {
+	root          string
+	allowSymlinks bool
+}
+
+// resolve returns the real path corresponding to the absolute virtual path
+// vpath. If allowSymlinks is false, any symbolic link encountered along the way
+// is rejected. Otherwise, links are followed as long as their targets stay
+// inside the root.
+//
+// Components that don't exist yet are joined lexically, so that the result can
+// be used to create new files and directories.
+//
+// The result is only checked at the time of the call. Opening it with
+// openBeneath guards against links swapped in since.
+func (r resolver) resolve(vpath string) (string, error) {
+	pending := splitPath(vpath)
+	var resolved []string
+	links := 0
+
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+
+		dir := filepath.Join(r.root, filepath.Join(resolved...))
+		name, fi, err := lstatName(dir, name)
+		real := filepath.Join(dir, name)
+		if os.IsNotExist(err) {
+			// Nothing below a missing component can be a symbolic link.
+			resolved = append(resolved, name)
+			resolved = append(resolved, pending...)
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, name)
+			continue
+		}
+
+		if !r.allowSymlinks {
+			return "", ErrSymlinkNotAllowed
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", ErrTooManySymlinks
+		}
+
+		target, err := os.Readlink(real)
+		if err != nil {
+			return "", err
+		}
+
+		// Translate the link target back into a virtual path, then restart the
+		// walk from the root with the rest of the path appended.
+		var targetVirtual string
+		if filepath.IsAbs(target) {
+			rel, err := filepath.Rel(r.root, target)
+			if err != nil {
+				return "", ErrInvalidSymlinkPath
+			}
+			targetVirtual = rel
+		} else {
+			targetVirtual = filepath.Join(filepath.Join(resolved...), target)
+		}
+
+		if escapesRoot(targetVirtual) {
+			return "", ErrPathEscapesRoot
+		}
+
+		pending = append(splitPath(targetVirtual), pending...)
+		resolved = resolved[:0]
+	}
+
+	return filepath.Join(r.root, filepath.Join(resolved...)), nil
+}
+
+// resolveLink is like resolve, but leaves the last component of vpath as it
+// is, like lstat(2) and unlink(2): only the directory holding it is resolved,
+// so that a symbolic link can be removed or renamed rather than its target.
+func (r resolver) resolveLink(vpath string) (string, error) {
+	parts := splitPath(vpath)
+	if len(parts) == 0 {
+		return r.root, nil
+	}
+
+	dir, err := r.resolve(filepath.Join(parts[:len(parts)-1]...))
+	if err != nil {
+		return "", err
+	}
+	name, _, _ := lstatName(dir, parts[len(parts)-1])
+	return filepath.Join(dir, name), nil
+}
+
+// lstatName looks up name in the real directory dir with os.Lstat. Names are
+// matched exactly as sent; only if there is no such entry are the NFC and NFD
+// forms of name tried, so that a name typed on a system that normalises
+// Unicode differently still finds the file. lstatName returns the name that
+// was found, or name itself.
+func lstatName(dir, name string) (string, os.FileInfo, error) {
+	fi, err := os.Lstat(filepath.Join(dir, name))
+	if !os.IsNotExist(err) {
+		return name, fi, err
+	}
+
+	for _, form := range []norm.Form{norm.NFC, norm.NFD} {
+		alt := form.String(name)
+		if alt == name {
+			continue
+		}
+		if fi, altErr := os.Lstat(filepath.Join(dir, alt)); altErr == nil {
+			return alt, fi, nil
+		}
+	}
+	return name, fi, err
+}
+
+// splitPath cleans the virtual path p and splits it into its components.
+// Leading ".." components are dropped, since the virtual root is its own
+// parent.
+func splitPath(p string) []string {
+	clean := filepath.Clean(string(filepath.Separator) + p)
+	var parts []string
+	for _, part := range strings.Split(clean, string(filepath.Separator)) {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	return parts
+}
+
+// escapesRoot reports whether the relative path p refers to a location above
+// the directory it is relative to.
+func escapesRoot(p string) bool {
+	clean := filepath.Clean(p)
+	return clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
+
+// relBeneath returns the real path p relative to root, which it must lie below.
+func relBeneath(root, p string) (string, error) {
+	rel, err := filepath.Rel(root, p)
+	if err != nil || escapesRoot(rel) {
+		return "", ErrPathEscapesRoot
+	}
+	return rel, nil
+}
+
+// checkMovedLinks checks that moving the file or directory at from to to,
+// where to lies below root, leaves every symbolic link among them pointing
+// below root. Relative links that stayed inside the tree where they were could
+// otherwise lead out of it from a different depth.
+func checkMovedLinks(root, from, to string) error {
+	return filepath.Walk(from, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			return err
+		}
+
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(target) {
+			rel, err := filepath.Rel(from, p)
+			if err != nil {
+				return err
+			}
+			target = filepath.Join(filepath.Dir(filepath.Join(to, rel)), target)
+		}
+
+		_, err = relBeneath(root, target)
+		return err
+	})
+}
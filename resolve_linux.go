@@ -0,0 +1,316 @@
+package charter
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Linux's openat2(2), available since 5.6. See include/uapi/linux/openat2.h.
+const (
+	sysOpenat2         = 437
+	resolveNoSymlinks  = 0x04
+	resolveBeneath     = 0x08
+	atRemoveDir        = 0x200
+	oPath              = 0x200000
+	utimeOmit          = 1<<30 - 2
+	beneathDirectories = syscall.O_RDONLY | syscall.O_DIRECTORY
+)
+
+type openHow struct {
+	flags   uint64
+	mode    uint64
+	resolve uint64
+}
+
+// noOpenat2 is set, atomically, the first time openat2 turns out to be
+// unavailable, after which openBeneath walks paths one component at a time
+// instead.
+var noOpenat2 int32
+
+// openBeneath opens the real path p, which must lie below root, refusing to
+// follow a symbolic link in any of its components. Paths returned by
+// resolver.resolve contain no links, so any link found here was swapped in
+// after the path was resolved, and would otherwise lead out of root. If root
+// is empty, p is opened as is.
+func openBeneath(root, p string, flag int, perm os.FileMode) (*os.File, error) {
+	if root == "" {
+		return os.OpenFile(p, flag, perm)
+	}
+
+	rel, err := relBeneath(root, p)
+	if err != nil {
+		return nil, err
+	}
+
+	rootFd, err := syscall.Open(root, beneathDirectories|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	defer syscall.Close(rootFd)
+
+	flag |= syscall.O_CLOEXEC | syscall.O_LARGEFILE
+	fd, err := openat2(rootFd, rel, flag, perm)
+	if err == syscall.ENOSYS {
+		atomic.StoreInt32(&noOpenat2, 1)
+		fd, err = walkBeneath(rootFd, rel, flag, perm)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+
+	return os.NewFile(uintptr(fd), p), nil
+}
+
+func openat2(dirfd int, rel string, flag int, perm os.FileMode) (int, error) {
+	if atomic.LoadInt32(&noOpenat2) != 0 {
+		return -1, syscall.ENOSYS
+	}
+
+	name, err := syscall.BytePtrFromString(rel)
+	if err != nil {
+		return -1, err
+	}
+	how := openHow{
+		flags:   uint64(flag),
+		mode:    uint64(syscallMode(perm)),
+		resolve: resolveBeneath | resolveNoSymlinks,
+	}
+
+	for {
+		fd, _, errno := syscall.Syscall6(sysOpenat2, uintptr(dirfd), uintptr(unsafe.Pointer(name)),
+			uintptr(unsafe.Pointer(&how)), unsafe.Sizeof(how), 0, 0)
+		switch errno {
+		case 0:
+			return int(fd), nil
+		case syscall.EINTR, syscall.EAGAIN:
+			continue
+		case syscall.ELOOP, syscall.EXDEV:
+			// A link, or a path leading out of root.
+			return -1, ErrPathEscapesRoot
+		}
+		return -1, errno
+	}
+}
+
+// walkBeneath opens rel below dirfd one component at a time with O_NOFOLLOW,
+// for kernels without openat2.
+func walkBeneath(dirfd int, rel string, flag int, perm os.FileMode) (int, error) {
+	parts := strings.Split(rel, string(filepath.Separator))
+	fd, err := syscall.Dup(dirfd)
+	if err != nil {
+		return -1, err
+	}
+
+	for i, part := range parts {
+		if part == ".." {
+			syscall.Close(fd)
+			return -1, ErrPathEscapesRoot
+		}
+
+		f := beneathDirectories | syscall.O_CLOEXEC
+		var mode uint32
+		if i == len(parts)-1 {
+			f, mode = flag, syscallMode(perm)
+		}
+
+		next, err := syscall.Openat(fd, part, f|syscall.O_NOFOLLOW, mode)
+		if err == syscall.ENOTDIR && isSymlinkAt(fd, part) {
+			// O_DIRECTORY takes precedence over O_NOFOLLOW.
+			err = syscall.ELOOP
+		}
+		syscall.Close(fd)
+		if err == syscall.ELOOP {
+			return -1, ErrPathEscapesRoot
+		} else if err != nil {
+			return -1, err
+		}
+		fd = next
+	}
+
+	return fd, nil
+}
+
+// isSymlinkAt reports whether name, in the directory dirfd, is a symbolic link.
+func isSymlinkAt(dirfd int, name string) bool {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return false
+	}
+	var buf [1]byte
+	_, _, errno := syscall.Syscall6(syscall.SYS_READLINKAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0, 0)
+	return errno == 0
+}
+
+// openParentBeneath opens the directory holding p like openBeneath, returning
+// it along with p's base name, for use with the *at system calls.
+func openParentBeneath(root, p string) (*os.File, string, error) {
+	dir, err := openBeneath(root, filepath.Dir(p), beneathDirectories, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	return dir, filepath.Base(p), nil
+}
+
+// removeBeneath removes the file or empty directory at p like os.Remove, but
+// without following symbolic links in its parent directories.
+func removeBeneath(root, p string) error {
+	dir, name, err := openParentBeneath(root, p)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	err = syscall.Unlinkat(int(dir.Fd()), name)
+	if err == syscall.EISDIR {
+		err = unlinkat(int(dir.Fd()), name, atRemoveDir)
+	}
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: p, Err: err}
+	}
+	return nil
+}
+
+func unlinkat(dirfd int, name string, flags int) error {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_UNLINKAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(flags))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// mkdirBeneath creates the directory p like os.Mkdir, but without following
+// symbolic links in its parent directories.
+func mkdirBeneath(root, p string, perm os.FileMode) error {
+	dir, name, err := openParentBeneath(root, p)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	if err := syscall.Mkdirat(int(dir.Fd()), name, syscallMode(perm)); err != nil {
+		return &os.PathError{Op: "mkdir", Path: p, Err: err}
+	}
+	return nil
+}
+
+// renameBeneath renames oldpath, below oldRoot, to newpath, below newRoot,
+// like os.Rename, but without following symbolic links in the parent
+// directories of either.
+func renameBeneath(oldRoot, oldpath, newRoot, newpath string) error {
+	oldDir, oldName, err := openParentBeneath(oldRoot, oldpath)
+	if err != nil {
+		return err
+	}
+	defer oldDir.Close()
+
+	newDir, newName, err := openParentBeneath(newRoot, newpath)
+	if err != nil {
+		return err
+	}
+	defer newDir.Close()
+
+	if err := syscall.Renameat(int(oldDir.Fd()), oldName, int(newDir.Fd()), newName); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
+
+func syscallMode(perm os.FileMode) uint32 {
+	mode := uint32(perm.Perm())
+	if perm&os.ModeSetuid != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if perm&os.ModeSetgid != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if perm&os.ModeSticky != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	return mode
+}
+
+// symlinkBeneath creates newname as a symbolic link to oldname like
+// os.Symlink, but without following symbolic links in its parent directories.
+func symlinkBeneath(root, oldname, newname string) error {
+	dir, name, err := openParentBeneath(root, newname)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	if err := symlinkat(oldname, int(dir.Fd()), name); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func symlinkat(oldname string, dirfd int, newname string) error {
+	o, err := syscall.BytePtrFromString(oldname)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(newname)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_SYMLINKAT, uintptr(unsafe.Pointer(o)), uintptr(dirfd), uintptr(unsafe.Pointer(n)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// chmodBeneath changes the mode of p like os.Chmod, without following symbolic
+// links like openBeneath. The file is opened with O_PATH, which needs no
+// access to the file itself, and changed through its entry in /proc/self/fd.
+func chmodBeneath(root, p string, mode os.FileMode) error {
+	f, err := openBeneath(root, p, oPath|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := syscall.Chmod(fdPath(f), syscallMode(mode)); err != nil {
+		return &os.PathError{Op: "chmod", Path: p, Err: err}
+	}
+	return nil
+}
+
+// chtimesBeneath changes the access and modification times of p like
+// os.Chtimes, without following symbolic links like chmodBeneath. A zero time
+// leaves the corresponding time unchanged.
+func chtimesBeneath(root, p string, atime, mtime time.Time) error {
+	f, err := openBeneath(root, p, oPath|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ts := []syscall.Timespec{timespec(atime), timespec(mtime)}
+	if err := syscall.UtimesNano(fdPath(f), ts); err != nil {
+		return &os.PathError{Op: "chtimes", Path: p, Err: err}
+	}
+	return nil
+}
+
+func fdPath(f *os.File) string {
+	return "/proc/self/fd/" + strconv.Itoa(int(f.Fd()))
+}
+
+func timespec(t time.Time) syscall.Timespec {
+	if t.IsZero() {
+		return syscall.Timespec{Nsec: utimeOmit}
+	}
+	return syscall.NsecToTimespec(t.UnixNano())
+}
@@ -0,0 +1,129 @@
+package charter
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenBeneath(t *testing.T) {
+	root, cleanup := setupJail(t)
+	defer cleanup()
+
+	outside := filepath.Join(filepath.Dir(root), "outside")
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "a", "b", "file"), []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fallback := range []bool{false, true} {
+		if fallback {
+			atomic.StoreInt32(&noOpenat2, 1)
+		}
+
+		f, err := openBeneath(root, filepath.Join(root, "a", "b", "file"), os.O_RDONLY, 0)
+		if assert.NoError(t, err) {
+			f.Close()
+		}
+
+		// The paths a resolver would produce for a directory that was swapped
+		// for a link after the path was resolved.
+		for _, p := range []string{
+			filepath.Join(root, "escape", "secret"),
+			filepath.Join(root, "a", "dot", "secret"),
+			filepath.Join(root, "a", "rel", "file"),
+		} {
+			_, err := openBeneath(root, p, os.O_RDONLY, 0)
+			assert.Equal(t, ErrPathEscapesRoot, pathErr(err), p)
+
+			_, err = openBeneath(root, p, os.O_WRONLY|os.O_TRUNC, 0)
+			assert.Equal(t, ErrPathEscapesRoot, pathErr(err), p)
+		}
+
+		_, err = openBeneath(root, filepath.Join(root, "..", "outside", "secret"), os.O_RDONLY, 0)
+		assert.Equal(t, ErrPathEscapesRoot, err)
+
+		assert.Equal(t, ErrPathEscapesRoot, pathErr(removeBeneath(root, filepath.Join(root, "escape", "secret"))))
+		assert.Equal(t, ErrPathEscapesRoot, pathErr(mkdirBeneath(root, filepath.Join(root, "escape", "dir"), 0755)))
+		assert.Equal(t, ErrPathEscapesRoot, pathErr(renameBeneath(root, filepath.Join(root, "escape", "secret"),
+			root, filepath.Join(root, "stolen"))))
+	}
+	atomic.StoreInt32(&noOpenat2, 0)
+
+	data, err := ioutil.ReadFile(filepath.Join(outside, "secret"))
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", string(data))
+	_, err = os.Lstat(filepath.Join(outside, "dir"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// runUnprivileged runs the calling test again in a child process as the
+// nobody user if the tests run as root, since root isn't subject to the
+// permission checks being tested. It reports whether the test ran in a child,
+// in which case the caller has nothing left to do.
+func runUnprivileged(t *testing.T) bool {
+	if os.Geteuid() != 0 || os.Getenv("CHARTER_TEST_UNPRIVILEGED") != "" {
+		return false
+	}
+
+	// The test binary is copied where nobody can run it from.
+	dir, err := ioutil.TempDir("", "charter-unprivileged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.Chmod(dir, 0755))
+
+	bin := filepath.Join(dir, "charter.test")
+	src, err := os.Open(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := os.OpenFile(bin, os.O_CREATE|os.O_WRONLY, 0755)
+	if err == nil {
+		_, err = io.Copy(dst, src)
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+	}
+	src.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(bin, "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), "CHARTER_TEST_UNPRIVILEGED=1", "TMPDIR=/tmp")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+	out, err := cmd.CombinedOutput()
+	assert.Nil(t, err, "%s", out)
+	return true
+}
+
+func TestChangeModeWithoutAccess(t *testing.T) {
+	if runUnprivileged(t) {
+		return
+	}
+
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(s.root, "f.txt"), []byte("data"), 0644))
+	s.expect("SITE CHMOD 200 f.txt", 200)
+	s.expect("MFMT 20200102030405 f.txt", 213)
+	s.expect("SITE UTIME 20200102030405 f.txt", 200)
+	s.expect("SITE CHMOD 000 f.txt", 200)
+	s.expect("SITE CHMOD 644 f.txt", 200)
+
+	stat, err := os.Stat(filepath.Join(s.root, "f.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0644), stat.Mode().Perm())
+}
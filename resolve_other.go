@@ -0,0 +1,46 @@
+//go:build !linux
+// +build !linux
+
+package charter
+
+import (
+	"os"
+	"time"
+)
+
+// On systems other than Linux, paths are opened as resolved, so a directory
+// swapped for a symbolic link after resolver.resolve has checked it is still
+// followed.
+
+func openBeneath(root, p string, flag int, perm os.FileMode) (*os.File, error) {
+	if root != "" {
+		if _, err := relBeneath(root, p); err != nil {
+			return nil, err
+		}
+	}
+	return os.OpenFile(p, flag, perm)
+}
+
+func removeBeneath(root, p string) error {
+	return os.Remove(p)
+}
+
+func mkdirBeneath(root, p string, perm os.FileMode) error {
+	return os.Mkdir(p, perm)
+}
+
+func renameBeneath(oldRoot, oldpath, newRoot, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func chmodBeneath(root, p string, mode os.FileMode) error {
+	return os.Chmod(p, mode)
+}
+
+func chtimesBeneath(root, p string, atime, mtime time.Time) error {
+	return os.Chtimes(p, atime, mtime)
+}
+
+func symlinkBeneath(root, oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
@@ -0,0 +1,139 @@
+package charter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setupJail(t *testing.T) (string, func()) {
+	base, err := ioutil.TempDir("", "charter-resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{root, outside, filepath.Join(root, "a", "b")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		filepath.Join(root, "up"):       "..",
+		filepath.Join(root, "escape"):   outside,
+		filepath.Join(root, "a", "rel"): "b",
+		filepath.Join(root, "a", "abs"): filepath.Join(root, "a", "b"),
+		filepath.Join(root, "a", "dot"): "../../outside",
+		filepath.Join(root, "loop"):     "loop",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root, func() { os.RemoveAll(base) }
+}
+
+func TestResolve(t *testing.T) {
+	root, cleanup := setupJail(t)
+	defer cleanup()
+
+	r := resolver{root: root}
+
+	tests := []struct {
+		path string
+		real string
+	}{
+		{path: "/", real: root},
+		{path: "/a/b", real: filepath.Join(root, "a", "b")},
+		{path: "/../../a", real: filepath.Join(root, "a")},
+		{path: "/a/../../..", real: root},
+		{path: "/missing/file", real: filepath.Join(root, "missing", "file")},
+	}
+
+	for _, tt := range tests {
+		real, err := r.resolve(tt.path)
+		assert.Nil(t, err, tt.path)
+		assert.Equal(t, tt.real, real, tt.path)
+	}
+}
+
+func TestResolveNormalisation(t *testing.T) {
+	root, cleanup := setupJail(t)
+	defer cleanup()
+
+	nfd := filepath.Join(root, "cafe\u0301")
+	nfc := filepath.Join(root, "a", "caf\u00e9")
+	for _, p := range []string{nfd, nfc} {
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := resolver{root: root}
+	tests := []struct {
+		path string
+		real string
+	}{
+		{path: "/cafe\u0301", real: nfd},
+		{path: "/caf\u00e9", real: nfd},
+		{path: "/a/caf\u00e9", real: nfc},
+		{path: "/a/cafe\u0301", real: nfc},
+		{path: "/a/b/cafe\u0301", real: filepath.Join(root, "a", "b", "cafe\u0301")},
+	}
+
+	for _, tt := range tests {
+		real, err := r.resolve(tt.path)
+		assert.Nil(t, err, tt.path)
+		assert.Equal(t, tt.real, real, tt.path)
+
+		real, err = r.resolveLink(tt.path)
+		assert.Nil(t, err, tt.path)
+		assert.Equal(t, tt.real, real, tt.path)
+	}
+}
+
+func TestResolveRejectsSymlinks(t *testing.T) {
+	root, cleanup := setupJail(t)
+	defer cleanup()
+
+	r := resolver{root: root}
+
+	for _, path := range []string{"/escape", "/a/rel", "/a/rel/file"} {
+		_, err := r.resolve(path)
+		assert.Equal(t, ErrSymlinkNotAllowed, err, path)
+	}
+}
+
+func TestResolveAllowedSymlinks(t *testing.T) {
+	root, cleanup := setupJail(t)
+	defer cleanup()
+
+	r := resolver{root: root, allowSymlinks: true}
+
+	tests := []struct {
+		path string
+		real string
+		err  error
+	}{
+		{path: "/a/rel", real: filepath.Join(root, "a", "b")},
+		{path: "/a/abs/new", real: filepath.Join(root, "a", "b", "new")},
+		{path: "/escape", err: ErrPathEscapesRoot},
+		{path: "/escape/file", err: ErrPathEscapesRoot},
+		{path: "/up", err: ErrPathEscapesRoot},
+		{path: "/a/dot", err: ErrPathEscapesRoot},
+		{path: "/loop", err: ErrTooManySymlinks},
+	}
+
+	for _, tt := range tests {
+		real, err := r.resolve(tt.path)
+		assert.Equal(t, tt.err, err, tt.path)
+		assert.Equal(t, tt.real, real, tt.path)
+	}
+}
@@ -7,8 +7,10 @@ import (
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/maybetheresloop/charter-go/passwd"
+	"golang.org/x/text/encoding"
 )
 
 type transmissionMode int
@@ -18,13 +20,55 @@ const (
 	ModeStream transmissionMode = iota
 	ModeBlock
 	ModeCompressed
+	ModeDeflate // MODE Z, a zlib-compressed stream.
 )
 
+func (mode transmissionMode) String() string {
+	switch mode {
+	case ModeBlock:
+		return "B"
+	case ModeCompressed:
+		return "C"
+	case ModeDeflate:
+		return "Z"
+	}
+	return "S"
+}
+
 const (
 	TypeASCII dataType = iota
 	TypeImage
 )
 
+func (t dataType) String() string {
+	if t == TypeASCII {
+		return "ASCII"
+	}
+	return "BINARY"
+}
+
+// skipWriter discards the first skip bytes written to it, passing the rest on
+// to w.
+type skipWriter struct {
+	w    io.Writer
+	skip int64
+}
+
+func (sw *skipWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if sw.skip >= int64(n) {
+		sw.skip -= int64(n)
+		return n, nil
+	}
+
+	p = p[sw.skip:]
+	sw.skip = 0
+	if _, err := sw.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
 type dataConnListener struct {
 	active bool
 	lis    net.Listener
@@ -33,9 +77,17 @@ type dataConnListener struct {
 type Server struct {
 	auth                []auth
 	config              *Config
-	passwdDb            passwd.DB
+	passwdDb            []*passwd.DB // One for each configured backend, tried in order.
+	passwdErr           error
 	dataConnListenersMu sync.Mutex
 	dataConnListeners   map[uint16]*dataConnListener
+	quotasMu            sync.Mutex
+	quotas              map[string]*quota
+	downloadsMu         sync.Mutex
+	downloads           map[string]time.Time // Completed downloads, for after-download retention rules.
+	hooks               *hookDispatcher
+	charset             encoding.Encoding
+	charsetErr          error
 }
 
 type auth struct {
@@ -47,6 +99,29 @@ type BackendConf struct {
 	DataSourceName string `toml:"data-source-name"`
 }
 
+// MountConf mounts the real directory Source at the virtual path Path in each
+// user's namespace. Occurrences of $USER in Source are replaced with the name
+// of the logged in user.
+type MountConf struct {
+	Path     string
+	Source   string
+	ReadOnly bool `toml:"read-only"`
+
+	// Quota limits the usage of Source, shared by every user mounting it.
+	Quota QuotaConf
+}
+
+// UserConf holds settings that apply to a single user.
+type UserConf struct {
+	// Quota limits the usage of the user's writable mounts.
+	Quota QuotaConf
+
+	// ArchiveDownloads lets the user download a directory as an archive
+	// generated on the fly, by retrieving its name with .zip, .tar.gz or .tgz
+	// appended.
+	ArchiveDownloads bool `toml:"archive-downloads"`
+}
+
 type PassivePortRange struct {
 	From uint16
 	To   uint16
@@ -59,12 +134,144 @@ type Config struct {
 	AnonymousOnly    bool `toml:"anonymous-only"`
 	Backend          []BackendConf
 	PassivePortRange PassivePortRange
+
+	// Mount assembles each user's namespace from several real directories. If
+	// empty, DefaultDir is mounted at the root.
+	Mount []MountConf
+
+	// Users holds per-user settings, keyed by user name.
+	Users map[string]UserConf `toml:"user"`
+
+	// AllowSymlinks permits following symbolic links whose targets stay inside
+	// the client's root directory. Links are never followed out of the root.
+	AllowSymlinks bool `toml:"allow-symlinks"`
+
+	// AtomicUploads writes STOR uploads to a hidden temporary file in the target
+	// directory, renaming it into place only once the upload completes.
+	AtomicUploads bool `toml:"atomic-uploads"`
+
+	// KeepPartialUploads keeps the temporary file of an interrupted atomic
+	// upload, so that the upload can be resumed with REST. Otherwise, it is
+	// deleted. SIZE reports the size of the kept file while the target doesn't
+	// exist; when replacing a file, the kept file can be queried by its hidden
+	// name, ".<name>.part".
+	KeepPartialUploads bool `toml:"keep-partial-uploads"`
+
+	// RecursiveDelete enables RMDA and SITE RMDIR -r, which remove a directory
+	// along with everything in it. RMD only ever removes empty directories.
+	RecursiveDelete bool `toml:"recursive-delete"`
+
+	// ArchiveMaxSize is the largest total size of the files in a directory that
+	// may be downloaded as an archive. Zero means unlimited.
+	ArchiveMaxSize int64 `toml:"archive-max-size"`
+
+	// ExtractMaxRatio limits the size of the contents of an archive extracted
+	// with SITE UNZIP or SITE UNTAR to this multiple of the archive's size. If
+	// zero, the limit is 100.
+	ExtractMaxRatio int64 `toml:"extract-max-ratio"`
+
+	// Versions is the number of previous versions kept of files replaced by
+	// STOR, under .versions/name.1, .versions/name.2 and so on, next to each
+	// file. Zero disables versioning.
+	Versions int
+
+	// TrashDir, if set, keeps what DELE, RMD, RMDA and SITE RMDIR remove in a
+	// trash for each user below it, from which it can be restored with SITE
+	// RESTORE. It must lie outside the mounted directories, but on the same
+	// filesystem, since removed files are moved into it.
+	TrashDir string `toml:"trash-dir"`
+
+	// TrashRetentionDays is the number of days after which entries are purged
+	// from the trash. If zero, they are kept until emptied with SITE TRASH
+	// EMPTY.
+	TrashRetentionDays int `toml:"trash-retention-days"`
+
+	// Retention lists rules expiring old files, which are applied hourly.
+	Retention []RetentionRule
+
+	// Hook lists external commands and webhooks to be notified of uploads,
+	// deletions and other changes made by clients.
+	Hook []HookConf
+
+	// HookQueueSize is the number of events queued per hook before further
+	// events are dropped. HookRetries is the number of times delivery of an
+	// event is retried after the hook fails. HookTimeoutSeconds bounds each
+	// delivery, for hooks that don't set their own timeout; if zero, it
+	// defaults to 30 seconds.
+	HookQueueSize      int `toml:"hook-queue-size"`
+	HookRetries        int `toml:"hook-retries"`
+	HookTimeoutSeconds int `toml:"hook-timeout-seconds"`
+
+	// Charset is the legacy character set, e.g. ISO-8859-1 or Shift_JIS, used
+	// for pathnames and reply text with clients that don't enable UTF-8 with
+	// OPTS UTF8 ON. If empty, UTF-8 is always used.
+	Charset string
 }
 
 // sendASCII copies from src to dst, translating native line endings in src to
-// CRLF line endings in dst.
+// CRLF line endings in dst. Line feeds already preceded by a carriage return are
+// left alone.
 func sendASCII(dst io.Writer, src io.Reader) error {
-	return nil
+	bufDst := bufio.NewWriter(dst)
+	bufSrc := bufio.NewReader(src)
+
+	var prev byte
+	for {
+		b, err := bufSrc.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if b == '\n' && prev != '\r' {
+			if err := bufDst.WriteByte('\r'); err != nil {
+				return err
+			}
+		}
+		if err := bufDst.WriteByte(b); err != nil {
+			return err
+		}
+		prev = b
+	}
+	return bufDst.Flush()
+}
+
+// asciiOffset reads src until it has seen the first n bytes of its translation
+// by sendASCII, and returns the corresponding offset in src. This maps sizes and
+// restart offsets of ASCII transfers onto the files on disk. If n is negative,
+// all of src is read, and its translated size is returned instead.
+func asciiOffset(src io.Reader, n int64) (int64, error) {
+	bufSrc := bufio.NewReader(src)
+
+	var prev byte
+	var srcOffset, dstOffset int64
+	for n < 0 || dstOffset < n {
+		b, err := bufSrc.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if b == '\n' && prev != '\r' {
+			dstOffset++
+		}
+		dstOffset++
+		srcOffset++
+		prev = b
+	}
+
+	if n < 0 {
+		return dstOffset, nil
+	}
+	if dstOffset != n {
+		// Either src is too short, or n splits a translated line ending.
+		return 0, ErrInvalidRestart
+	}
+	return srcOffset, nil
 }
 
 // copyASCII copies from src to dst, translating CRLF line endings in src to
@@ -113,6 +320,22 @@ func NewServer(config *Config) *Server {
 	srv := &Server{
 		config:            config,
 		dataConnListeners: make(map[uint16]*dataConnListener),
+		quotas:            make(map[string]*quota),
+		downloads:         make(map[string]time.Time),
+		hooks:             newHookDispatcher(config),
+	}
+
+	if config.Charset != "" {
+		srv.charset, srv.charsetErr = lookupCharset(config.Charset)
+	}
+
+	for _, backend := range config.Backend {
+		db, err := passwd.Open(backend.Name, backend.DataSourceName)
+		if err != nil {
+			srv.passwdErr = fmt.Errorf("backend %s: %v", backend.Name, err)
+			break
+		}
+		srv.passwdDb = append(srv.passwdDb, db)
 	}
 
 	return srv
@@ -177,6 +400,19 @@ func (srv *Server) releaseDataPort(port uint16) {
 
 func (srv *Server) Serve(lis net.Listener) error {
 	defer lis.Close()
+	if srv.charsetErr != nil {
+		return srv.charsetErr
+	}
+	if srv.passwdErr != nil {
+		return srv.passwdErr
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if srv.needsJanitor() {
+		go srv.janitor(janitorInterval, stop)
+	}
+
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
@@ -191,11 +427,11 @@ func (srv *Server) Serve(lis net.Listener) error {
 }
 
 func (srv *Server) newClient(conn net.Conn) *Client {
-	return &Client{
-		ctrlConn:   conn,
-		server:     srv,
-		response:   &bytes.Buffer{},
-		rootDir:    srv.config.DefaultDir,
-		workingDir: "/",
+	client := &Client{
+		ctrlConn: conn,
+		server:   srv,
+		response: &bytes.Buffer{},
 	}
+	client.reinitialize()
+	return client
 }
@@ -0,0 +1,93 @@
+package charter
+
+import (
+	"compress/zlib"
+	"errors"
+	"os"
+
+	"github.com/maybetheresloop/charter-go/passwd"
+)
+
+// defaultUmask is the umask of new sessions, until changed with SITE UMASK.
+const defaultUmask os.FileMode = 022
+
+// sessionState is the stage of the login sequence a session has reached.
+type sessionState int
+
+const (
+	stateConnected sessionState = iota // Awaiting USER.
+	stateUserGiven                     // Awaiting PASS.
+	stateLoggedIn
+)
+
+var ErrLoginIncorrect = errors.New("login incorrect")
+
+// isAnonymous reports whether user is one of the names used for anonymous
+// logins.
+func isAnonymous(user string) bool {
+	return user == "anonymous" || user == "ftp"
+}
+
+// authenticate checks the credentials given with USER and PASS. Anonymous
+// logins are accepted with any password unless disabled; other users must be
+// known to one of the configured backends, unless only anonymous logins are
+// allowed.
+func (srv *Server) authenticate(user, pass string) error {
+	if isAnonymous(user) {
+		if srv.config.NoAnonymous {
+			return ErrLoginIncorrect
+		}
+		return nil
+	}
+	if srv.config.AnonymousOnly {
+		return ErrLoginIncorrect
+	}
+
+	for _, db := range srv.passwdDb {
+		if err := db.CheckUserPassword(user, pass); err == nil {
+			return nil
+		} else if err != passwd.ErrNotExist {
+			return ErrLoginIncorrect
+		}
+	}
+	return ErrLoginIncorrect
+}
+
+// logout flushes the session's credentials and everything derived from them,
+// returning it to the start of the login sequence. Transfer parameters are
+// kept.
+func (client *Client) logout() {
+	client.state = stateConnected
+	client.username = ""
+	client.mounts = nil
+	client.quotas = nil
+	client.workingDir = "/"
+	client.renameFrom = ""
+	client.copyFrom = ""
+	client.restOffset = 0
+	client.hashRange = nil
+}
+
+// reinitialize logs the session out and resets its transfer parameters to
+// their defaults, as if the control connection had just been opened.
+func (client *Client) reinitialize() {
+	client.logout()
+	client.closeDataListener()
+	client.activeAddr = nil
+	client.dataType = TypeASCII
+	client.mode = ModeStream
+	client.structure = StructureFile
+	client.deflateLevel = zlib.DefaultCompression
+	client.hashAlgo = hashAlgorithms[0]
+	client.umask = defaultUmask
+	client.utf8 = client.server.charset == nil
+	client.lang = languages[0]
+}
+
+// reinHandler handles REIN. Any transfer in progress has already completed,
+// since REIN waits for it like other commands.
+func reinHandler(client *Client, command FtpCommand) (isExiting bool) {
+	client.reinitialize()
+	_ = client.sendReply(220, "Service ready for new user")
+	return
+}
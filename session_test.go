@@ -0,0 +1,89 @@
+package charter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginSequence(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	s.expect("PASS secret", 503)
+
+	// A new USER logs the session out until the password is given.
+	s.expect("TYPE I", 200)
+	s.expect("USER bob", 331)
+	s.expect("PWD", 530)
+	s.expect("PASS secret", 230)
+	assert.Contains(t, s.expect("STAT", 211), "TYPE: BINARY")
+}
+
+func TestRein(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	s.expect("TYPE I", 200)
+	s.expect("MODE B", 200)
+	s.expect("REIN", 220)
+	s.expect("PWD", 530)
+	s.expect("XYZZY", 500)
+	s.expect("PASS secret", 503)
+	s.expect("NOOP", 200)
+
+	s.expect("USER alice", 331)
+	s.expect("PASS secret", 230)
+	assert.Contains(t, s.expect("STAT", 211), "TYPE: ASCII, STRU: F, MODE: S")
+}
+
+func TestInvalidUsername(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	for _, name := range []string{".", "..", "../../secret", "a/b", `a\b`, "a\x00b"} {
+		s.expect("USER "+name, 501)
+		s.expect("PASS secret", 503)
+	}
+
+	s.expect("USER alice", 331)
+	s.expect("PASS secret", 230)
+}
+
+func TestAuthentication(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	s.expect("USER alice", 331)
+	s.expect("PASS wrong", 530)
+	s.expect("PWD", 530)
+	s.expect("PASS secret", 503)
+
+	s.expect("USER mallory", 331)
+	s.expect("PASS secret", 530)
+
+	s.expect("USER anonymous", 331)
+	s.expect("PASS guest@example.com", 230)
+
+	s.expect("USER alice", 331)
+	s.expect("PASS secret", 230)
+}
+
+func TestAnonymousLogins(t *testing.T) {
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.NoAnonymous = true
+	})
+	defer cleanup()
+
+	s.expect("USER anonymous", 331)
+	s.expect("PASS guest", 530)
+	s.expect("USER ftp", 331)
+	s.expect("PASS guest", 530)
+
+	s.srv.config.NoAnonymous = false
+	s.srv.config.AnonymousOnly = true
+	s.expect("USER alice", 331)
+	s.expect("PASS secret", 530)
+	s.expect("USER ftp", 331)
+	s.expect("PASS guest", 230)
+}
@@ -0,0 +1,284 @@
+package charter
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SiteCommands holds the sub-commands of SITE, keyed by their upper-case
+// names. The argument following the sub-command's name is passed to its
+// handler in the same way as for top-level commands.
+var SiteCommands map[string]Command
+
+func init() {
+	SiteCommands = map[string]Command{
+		"CHMOD": {
+			argc:    2,
+			handler: siteChmodHandler,
+			parse:   parseChmod,
+			help:    "CHMOD <mode> <path>",
+		},
+		"CPFR": {
+			argc:    1,
+			handler: siteCpfrHandler,
+			help:    "CPFR <path>",
+		},
+		"CPTO": {
+			argc:     1,
+			handler:  siteCptoHandler,
+			help:     "CPTO <path>",
+			transfer: true,
+		},
+		"HELP": {
+			argc:    0,
+			handler: siteHelpHandler,
+			help:    "HELP [<command>]",
+		},
+		"QUOTA": {
+			argc:    0,
+			handler: siteQuotaHandler,
+			help:    "QUOTA [RESCAN]",
+		},
+		"RESTORE": {
+			argc:    1,
+			handler: siteRestoreHandler,
+			parse:   parseRestoreArg,
+			help:    "RESTORE <name> [<path>]",
+		},
+		"RMDIR": {
+			argc:    1,
+			handler: siteRmdirHandler,
+			help:    "RMDIR [-r] <path>",
+		},
+		"SYMLINK": {
+			argc:    2,
+			handler: siteSymlinkHandler,
+			parse:   parsePathPair,
+			help:    "SYMLINK <target> <link>",
+		},
+		"TRASH": {
+			argc:    0,
+			handler: siteTrashHandler,
+			help:    "TRASH [LIST | EMPTY]",
+		},
+		"UMASK": {
+			argc:    0,
+			handler: siteUmaskHandler,
+			help:    "UMASK [<mask>]",
+		},
+		"UNTAR": {
+			argc:     1,
+			handler:  extractHandler(walkTar),
+			parse:    parseExtractArg,
+			help:     "UNTAR <archive> [<directory>]",
+			transfer: true,
+		},
+		"UNZIP": {
+			argc:     1,
+			handler:  extractHandler(walkZip),
+			parse:    parseExtractArg,
+			help:     "UNZIP <archive> [<directory>]",
+			transfer: true,
+		},
+		"UTIME": {
+			argc:    2,
+			handler: siteUtimeHandler,
+			parse:   parseUtime,
+			help:    "UTIME <YYYYMMDDhhmm[ss]> <path> | <path> <atime> <mtime> <ctime> UTC",
+		},
+		"VERSIONS": {
+			argc:    1,
+			handler: siteVersionsHandler,
+			help:    "VERSIONS <path>",
+		},
+	}
+}
+
+// SiteHandler handles a SITE sub-command. The command's name is that of the
+// sub-command, and its argument is the text following it. Handlers reply to
+// the client with Client.Reply.
+type SiteHandler func(client *Client, command FtpCommand)
+
+// RegisterSiteCommand adds the SITE sub-command name, replacing any existing
+// sub-command of the same name. help is the usage shown by SITE HELP. Commands
+// must be registered before the server starts serving.
+func RegisterSiteCommand(name, help string, handler SiteHandler) {
+	SiteCommands[strings.ToUpper(name)] = Command{
+		handler: func(client *Client, command FtpCommand) (isExiting bool) {
+			handler(client, command)
+			return
+		},
+		help: help,
+	}
+}
+
+func siteHandler(client *Client, command FtpCommand) (isExiting bool) {
+	sub, _ := ParseLine(command.Arg)
+	name := strings.ToUpper(sub.Command)
+
+	// Like a pending rename, a pending copy is only completed by the command
+	// immediately following SITE CPFR.
+	if name != "CPTO" {
+		client.copyFrom = ""
+	}
+
+	siteCmd, ok := SiteCommands[name]
+	if !ok {
+		_ = client.sendReply(500, "Unknown SITE command.")
+		return
+	}
+
+	if len(sub.Params) < siteCmd.argc {
+		_ = client.sendReply(501, "Wrong number of arguments.")
+		return
+	}
+
+	if siteCmd.parse != nil {
+		var err error
+		sub.Value, err = siteCmd.parse(sub.Arg)
+		if err != nil {
+			_ = client.sendReply(501, "Syntax error in parameters: %v", err)
+			return
+		}
+	}
+
+	if siteCmd.transfer {
+		client.startTransfer(siteCmd.handler, sub)
+		return
+	}
+	return siteCmd.handler(client, sub)
+}
+
+func siteHelpHandler(client *Client, command FtpCommand) (isExiting bool) {
+	if command.Arg != "" {
+		name := strings.ToUpper(strings.TrimSpace(command.Arg))
+		siteCmd, ok := SiteCommands[name]
+		if !ok {
+			_ = client.sendReply(501, "Unknown SITE command %s", name)
+			return
+		}
+
+		usage := siteCmd.help
+		if usage == "" {
+			usage = name
+		}
+		_ = client.sendReply(214, "Syntax: SITE %s", usage)
+		return
+	}
+
+	names := make([]string, 0, len(SiteCommands))
+	for name := range SiteCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = name
+		if help := SiteCommands[name].help; help != "" {
+			lines[i] = help
+		}
+	}
+	_ = client.sendMultilineReply(214, "The following SITE commands are recognized:", lines, "End")
+	return
+}
+
+func siteChmodHandler(client *Client, command FtpCommand) (isExiting bool) {
+	arg := command.Value.(chmodArg)
+	realPath, err := client.writablePath(arg.path)
+	if err != nil {
+		_ = client.sendReply(550, "Can't change mode of %s: %v", arg.path, err)
+		return
+	}
+
+	if err := client.chmodReal(realPath, arg.mode); err != nil {
+		_ = client.sendReply(550, "Can't change mode of %s: %v", arg.path, pathErr(err))
+		return
+	}
+
+	_ = client.sendReply(200, "SITE CHMOD command successful")
+	return
+}
+
+func siteUtimeHandler(client *Client, command FtpCommand) (isExiting bool) {
+	arg := command.Value.(utimeArg)
+	realPath, err := client.writablePath(arg.path)
+	if err != nil {
+		_ = client.sendReply(550, "Can't change times of %s: %v", arg.path, err)
+		return
+	}
+
+	if err := client.chtimesReal(realPath, arg.atime, arg.mtime); err != nil {
+		_ = client.sendReply(550, "Can't change times of %s: %v", arg.path, pathErr(err))
+		return
+	}
+
+	_ = client.sendReply(200, "SITE UTIME command successful")
+	return
+}
+
+// siteSymlinkHandler creates a symbolic link. The link is relative, and may
+// only point within the mount holding it, so that it resolves to the same file
+// for every user and never leads out of the jail.
+func siteSymlinkHandler(client *Client, command FtpCommand) (isExiting bool) {
+	paths := command.Value.([2]string)
+	target, link := client.virtualPath(paths[0]), paths[1]
+
+	if !client.server.config.AllowSymlinks {
+		_ = client.sendReply(550, "Can't create %s: %v", link, ErrSymlinkNotAllowed)
+		return
+	}
+
+	realLink, err := client.writablePath(link)
+	if err != nil {
+		_ = client.sendReply(550, "Can't create %s: %v", link, err)
+		return
+	}
+
+	realTarget, err := client.realPath(target)
+	if err != nil {
+		_ = client.sendReply(550, "Can't link to %s: %v", target, pathErr(err))
+		return
+	}
+
+	targetMount, _ := client.mounts.lookup(target)
+	linkMount, _ := client.mounts.lookup(client.virtualPath(link))
+	if targetMount != linkMount {
+		_ = client.sendReply(550, "Can't link to %s: %v", target, ErrPathEscapesRoot)
+		return
+	}
+
+	rel, err := filepath.Rel(filepath.Dir(realLink), realTarget)
+	if err != nil {
+		_ = client.sendReply(550, "Can't link to %s: %v", target, err)
+		return
+	}
+
+	if err := symlinkBeneath(client.rootOf(realLink), rel, realLink); err != nil {
+		_ = client.sendReply(550, "Can't create %s: %v", link, pathErr(err))
+		return
+	}
+
+	_ = client.sendReply(200, "SITE SYMLINK command successful")
+	return
+}
+
+func siteUmaskHandler(client *Client, command FtpCommand) (isExiting bool) {
+	if command.Arg == "" {
+		_ = client.sendReply(200, "Current UMASK is %03o", client.umask)
+		return
+	}
+
+	mask, err := strconv.ParseUint(strings.TrimSpace(command.Arg), 8, 32)
+	if err != nil || mask > 0777 {
+		_ = client.sendReply(501, "Invalid umask %s", command.Arg)
+		return
+	}
+
+	client.umask = os.FileMode(mask)
+	_ = client.sendReply(200, "UMASK set to %03o", client.umask)
+	return
+}
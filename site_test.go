@@ -0,0 +1,82 @@
+package charter
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUtime(t *testing.T) {
+	v, err := parseUtime("20200102030405 deploy.sh")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), v.(utimeArg).mtime)
+
+	v, err = parseUtime("my file.txt 20200102030405 20210102030405 20200102030405 UTC")
+	assert.Nil(t, err)
+	assert.Equal(t, "my file.txt", v.(utimeArg).path)
+	assert.Equal(t, 2020, v.(utimeArg).atime.Year())
+	assert.Equal(t, 2021, v.(utimeArg).mtime.Year())
+
+	v, err = parseUtime("202001020304 deploy.sh")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2020, 1, 2, 3, 4, 0, 0, time.UTC), v.(utimeArg).mtime)
+
+	tv, err := parseTimeVal("20200102030405.250")
+	assert.Nil(t, err)
+	assert.Equal(t, 250*time.Millisecond, time.Duration(tv.Nanosecond()))
+
+	_, err = parseUtime("yesterday deploy.sh")
+	assert.NotNil(t, err)
+}
+
+func TestSite(t *testing.T) {
+	RegisterSiteCommand("WHOAMI", "WHOAMI", func(client *Client, command FtpCommand) {
+		_ = client.Reply(200, "%s", client.User())
+	})
+	defer delete(SiteCommands, "WHOAMI")
+
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.AllowSymlinks = true
+	})
+	defer cleanup()
+
+	assert.Nil(t, ioutil.WriteFile(s.root+"/deploy.sh", []byte("#!/bin/sh\n"), 0644))
+
+	assert.Equal(t, "alice", s.expect("SITE WHOAMI", 200))
+	help := s.expect("SITE HELP", 214)
+	assert.Contains(t, help, "CHMOD <mode> <path>")
+	assert.Contains(t, help, "WHOAMI")
+	s.expect("SITE HELP UMASK", 214)
+	s.expect("SITE FROB", 500)
+
+	s.expect("SITE CHMOD 755 deploy.sh", 200)
+	s.expect("SITE CHMOD 4755 deploy.sh", 501)
+	stat, err := os.Stat(s.root + "/deploy.sh")
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0755), stat.Mode().Perm())
+
+	s.expect("SITE UTIME 20200102030405 deploy.sh", 200)
+	stat, err = os.Stat(s.root + "/deploy.sh")
+	assert.Nil(t, err)
+	assert.True(t, stat.ModTime().Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)))
+
+	s.expect("SITE SYMLINK deploy.sh current", 200)
+	target, err := os.Readlink(s.root + "/current")
+	assert.Nil(t, err)
+	assert.Equal(t, "deploy.sh", target)
+	s.expect("SITE SYMLINK ../../etc/passwd escape", 200)
+	target, err = os.Readlink(s.root + "/escape")
+	assert.Nil(t, err)
+	assert.Equal(t, "etc/passwd", target)
+
+	assert.Equal(t, "Current UMASK is 022", s.expect("SITE UMASK", 200))
+	s.expect("SITE UMASK 002", 200)
+	s.expect("MKD shared", 257)
+	stat, err = os.Stat(s.root + "/shared")
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0775), stat.Mode().Perm())
+	s.expect("SITE UMASK 999", 501)
+}
@@ -0,0 +1,189 @@
+package charter
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// Stream mode control codes for record structure. See RFC 959, section 3.4.1.
+const (
+	recordEscape = 0xFF
+	recordEOR    = 0x01
+	recordEOF    = 0x02
+)
+
+var errBadRecordCode = errors.New("invalid record structure control code")
+
+// recordEncoder is a writer for transfers with record structure.
+type recordEncoder interface {
+	io.WriteCloser
+
+	// EndRecord marks the end of a record.
+	EndRecord() error
+}
+
+// streamRecordWriter encodes records in stream mode, escaping the escape byte
+// in the data and marking the ends of records and of the file with control
+// codes.
+type streamRecordWriter struct {
+	w io.WriteCloser
+}
+
+func (sw streamRecordWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, recordEscape)
+		if i < 0 {
+			_, err := sw.w.Write(p)
+			return n, err
+		}
+
+		if _, err := sw.w.Write(p[:i+1]); err != nil {
+			return 0, err
+		}
+		if _, err := sw.w.Write([]byte{recordEscape}); err != nil {
+			return 0, err
+		}
+		p = p[i+1:]
+	}
+
+	return n, nil
+}
+
+func (sw streamRecordWriter) EndRecord() error {
+	_, err := sw.w.Write([]byte{recordEscape, recordEOR})
+	return err
+}
+
+func (sw streamRecordWriter) Close() error {
+	if _, err := sw.w.Write([]byte{recordEscape, recordEOF}); err != nil {
+		return err
+	}
+	return sw.w.Close()
+}
+
+// lineRecordWriter sends each line of a file written to it as a record, with
+// its line ending removed.
+type lineRecordWriter struct {
+	enc recordEncoder
+}
+
+func (lw lineRecordWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			_, err := lw.enc.Write(p)
+			return n, err
+		}
+
+		if _, err := lw.enc.Write(p[:i]); err != nil {
+			return 0, err
+		}
+		if err := lw.enc.EndRecord(); err != nil {
+			return 0, err
+		}
+		p = p[i+1:]
+	}
+
+	return n, nil
+}
+
+func (lw lineRecordWriter) Close() error {
+	return lw.enc.Close()
+}
+
+// streamRecordReader decodes records sent in stream mode, terminating each
+// record with a newline.
+type streamRecordReader struct {
+	r   *bufio.Reader
+	eof bool
+}
+
+func (sr *streamRecordReader) Read(p []byte) (int, error) {
+	if sr.eof {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) {
+		// Only block on the first byte, so that data is passed on as it arrives.
+		if n > 0 && sr.r.Buffered() == 0 {
+			break
+		}
+
+		b, err := sr.r.ReadByte()
+		if err == io.EOF {
+			return n, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return n, err
+		}
+
+		if b != recordEscape {
+			p[n] = b
+			n++
+			continue
+		}
+
+		code, err := sr.r.ReadByte()
+		if err != nil {
+			return n, io.ErrUnexpectedEOF
+		}
+
+		switch {
+		case code == recordEscape:
+			p[n] = recordEscape
+			n++
+		case code&^(recordEOR|recordEOF) != 0 || code == 0:
+			return n, errBadRecordCode
+		default:
+			if code&recordEOR != 0 {
+				p[n] = '\n'
+				n++
+			}
+			if code&recordEOF != 0 {
+				sr.eof = true
+				return n, nil
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// structureWriter wraps w, a writer returned by dataWriter, so that files sent
+// through it are transferred in the session's file structure.
+func (client *Client) structureWriter(w io.WriteCloser) io.WriteCloser {
+	if client.structure != StructureRecord {
+		return w
+	}
+
+	if enc, ok := w.(recordEncoder); ok {
+		return lineRecordWriter{enc: enc}
+	}
+	return lineRecordWriter{enc: streamRecordWriter{w: w}}
+}
+
+// translateASCII reports whether line endings are translated between the
+// network's CRLF and the host's LF. With record structure, records carry no line
+// endings, so there is nothing to translate.
+func (client *Client) translateASCII() bool {
+	return client.dataType == TypeASCII && client.structure == StructureFile
+}
+
+func struHandler(client *Client, command FtpCommand) (isExiting bool) {
+	switch stru := command.Value.(fileStructure); stru {
+	case StructureFile:
+		client.structure = stru
+		_ = client.sendReply(200, "Structure set to F")
+	case StructureRecord:
+		client.structure = stru
+		_ = client.sendReply(200, "Structure set to R")
+	default:
+		_ = client.sendReply(504, "Page structure not supported")
+	}
+	return
+}
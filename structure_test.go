@@ -0,0 +1,64 @@
+package charter
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamRecords(t *testing.T) {
+	var encoded bytes.Buffer
+	w := lineRecordWriter{enc: streamRecordWriter{w: nopWriteCloser{&encoded}}}
+	_, err := w.Write([]byte("one\ntw\xffo\nthree"))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	assert.Equal(t, "one\xff\x01tw\xff\xffo\xff\x01three\xff\x02", encoded.String())
+
+	decoded, err := ioutil.ReadAll(&streamRecordReader{r: bufio.NewReader(&encoded)})
+	assert.Nil(t, err)
+	assert.Equal(t, "one\ntw\xffo\nthree", string(decoded))
+}
+
+func TestStreamRecordsTruncated(t *testing.T) {
+	_, err := ioutil.ReadAll(&streamRecordReader{r: bufio.NewReader(bytes.NewBufferString("one\xff\x01"))})
+	assert.Equal(t, "unexpected EOF", err.Error())
+}
+
+func TestBlockRecords(t *testing.T) {
+	var encoded bytes.Buffer
+	w := lineRecordWriter{enc: newBlockWriter(&encoded)}
+	_, err := w.Write([]byte("one\n\ntwo\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+
+	br := newBlockReader(&encoded)
+	br.records = true
+	decoded, err := ioutil.ReadAll(br)
+	assert.Nil(t, err)
+	assert.Equal(t, "one\n\ntwo\n", string(decoded))
+}
+
+func TestStru(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	assert.Nil(t, ioutil.WriteFile(s.root+"/lines.txt", []byte("a\nb\n"), 0644))
+
+	s.expect("STRU P", 504)
+	s.expect("STRU R", 200)
+	s.expect("REST 1", 504)
+
+	_, data := s.transfer("RETR lines.txt", nil)
+	assert.Equal(t, "a\xff\x01b\xff\x01\xff\x02", string(data))
+
+	code, _ := s.transfer("STOR copy.txt", []byte("x\xff\x01y\xff\x03"))
+	assert.Equal(t, 226, code)
+	content, err := ioutil.ReadFile(s.root + "/copy.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "x\ny\n", string(content))
+
+	s.expect("STRU F", 200)
+}
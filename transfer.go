@@ -0,0 +1,262 @@
+package charter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errTransferAborted = errors.New("transfer aborted")
+
+// Telnet commands that may precede ABOR. See RFC 959, section 4.1.3, and RFC
+// 854.
+const (
+	telnetIAC  = 255
+	telnetDONT = 254
+	telnetWILL = 251
+	telnetSE   = 240
+)
+
+// transfer is a data transfer running in the background, so that the control
+// connection can still be read while it is in progress.
+type transfer struct {
+	bytes   int64 // Bytes sent or received on the data connection, accessed atomically.
+	command string
+	start   time.Time
+	done    chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	aborted bool
+	lis     net.Listener // The listener being accepted on, if any.
+	conn    net.Conn     // The data connection, once open.
+}
+
+func (t *transfer) abort() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.aborted = true
+	t.cancel()
+	if t.conn != nil {
+		_ = t.conn.Close()
+	}
+	if d, ok := t.lis.(interface{ SetDeadline(time.Time) error }); ok {
+		_ = d.SetDeadline(time.Now())
+	}
+}
+
+func (t *transfer) isAborted() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.aborted
+}
+
+// accept waits for a connection on lis, unless the transfer is aborted first.
+func (t *transfer) accept(lis net.Listener) (net.Conn, error) {
+	t.mu.Lock()
+	if t.aborted {
+		t.mu.Unlock()
+		return nil, errTransferAborted
+	}
+	if d, ok := lis.(interface{ SetDeadline(time.Time) error }); ok {
+		_ = d.SetDeadline(time.Time{})
+	}
+	t.lis = lis
+	t.mu.Unlock()
+
+	conn, err := lis.Accept()
+	return t.opened(conn, err)
+}
+
+// dial connects to addr, unless the transfer is aborted first.
+func (t *transfer) dial(addr *net.TCPAddr) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(t.ctx, "tcp", addr.String())
+	return t.opened(conn, err)
+}
+
+func (t *transfer) opened(conn net.Conn, err error) (net.Conn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lis = nil
+	if t.aborted {
+		if err == nil {
+			_ = conn.Close()
+		}
+		return nil, errTransferAborted
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t.conn = conn
+	return countingConn{Conn: conn, n: &t.bytes}, nil
+}
+
+// countingConn counts the bytes read from and written to a connection.
+type countingConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// startTransfer runs handler in the background. Only one transfer runs at a
+// time; the caller waits for the previous one to finish first.
+func (client *Client) startTransfer(handler commandHandler, command FtpCommand) {
+	t := &transfer{
+		command: strings.TrimSpace(command.Command + " " + command.Arg),
+		start:   time.Now(),
+		done:    make(chan struct{}),
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+
+	client.transferMu.Lock()
+	client.transfer = t
+	client.transferMu.Unlock()
+
+	go func() {
+		defer close(t.done)
+		defer t.cancel()
+
+		handler(client, command)
+
+		client.transferMu.Lock()
+		client.transfer = nil
+		client.transferMu.Unlock()
+	}()
+}
+
+// currentTransfer returns the transfer in progress, or nil if there isn't one.
+func (client *Client) currentTransfer() *transfer {
+	client.transferMu.Lock()
+	defer client.transferMu.Unlock()
+	return client.transfer
+}
+
+// waitTransfer waits for the transfer in progress, if any, to finish.
+func (client *Client) waitTransfer() {
+	if t := client.currentTransfer(); t != nil {
+		<-t.done
+	}
+}
+
+// abortTransfer aborts the transfer in progress, if any, and waits for it to
+// finish.
+func (client *Client) abortTransfer() bool {
+	t := client.currentTransfer()
+	if t == nil {
+		return false
+	}
+
+	t.abort()
+	<-t.done
+	return true
+}
+
+// transferAborted reports whether the running transfer was aborted with ABOR.
+func (client *Client) transferAborted() bool {
+	t := client.currentTransfer()
+	return t != nil && t.isAborted()
+}
+
+// stripTelnet removes Telnet commands, such as the Interrupt Process and Data
+// Mark that clients send before ABOR, from a line read from the control
+// connection. An escaped IAC is kept as a single 0xFF byte.
+func stripTelnet(line string) string {
+	if strings.IndexByte(line, telnetIAC) < 0 {
+		return line
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(line); i++ {
+		if line[i] != telnetIAC || i+1 == len(line) || line[i+1] < telnetSE {
+			b.WriteByte(line[i])
+			continue
+		}
+
+		i++
+		switch code := line[i]; {
+		case code == telnetIAC:
+			b.WriteByte(telnetIAC)
+		case code >= telnetWILL && code <= telnetDONT:
+			i++ // Skip the option.
+		}
+	}
+	return b.String()
+}
+
+func aborHandler(client *Client, command FtpCommand) (isExiting bool) {
+	if !client.abortTransfer() {
+		_ = client.sendReply(226, "No transfer to abort")
+		return
+	}
+
+	_ = client.sendReply(226, "Abort successful")
+	return
+}
+
+// statHandler reports the progress of the transfer in progress, the status of
+// the session, or, given a pathname, lists it over the control connection.
+func statHandler(client *Client, command FtpCommand) (isExiting bool) {
+	if t := client.currentTransfer(); t != nil {
+		_ = client.sendMultilineReply(213, "Status of transfer:", []string{
+			fmt.Sprintf("%s: %d bytes transferred in %s", t.command,
+				atomic.LoadInt64(&t.bytes), time.Since(t.start).Truncate(time.Second)),
+		}, "End of status")
+		return
+	}
+
+	if command.Arg == "" {
+		connection := "No data connection"
+		if client.activeAddr != nil {
+			connection = "Active mode to " + client.activeAddr.String()
+		} else if client.dataLis != nil {
+			connection = fmt.Sprintf("Passive mode on port %d", client.dataPort)
+		}
+
+		_ = client.sendMultilineReply(211, "FTP server status:", []string{
+			"Logged in as " + client.username,
+			fmt.Sprintf("TYPE: %s, STRU: %s, MODE: %s", client.dataType, client.structure, client.mode),
+			connection,
+		}, "End of status")
+		return
+	}
+
+	_, pathname := splitListArg(command.Arg)
+	dir := client.virtualPath(pathname)
+	infos, err := client.listDir(dir)
+	if err != nil {
+		_ = client.sendReply(450, "Can't list %s: %v", dir, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	_ = writeList(&buf, infos)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+	if buf.Len() == 0 {
+		lines = nil
+	}
+	_ = client.sendMultilineReply(213, "Status of "+dir+":", lines, "End of status")
+	return
+}
@@ -0,0 +1,195 @@
+package charter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripTelnet(t *testing.T) {
+	assert.Equal(t, "ABOR", stripTelnet("\xff\xf4\xff\xf2ABOR"))
+	assert.Equal(t, "ABOR", stripTelnet("\xff\xfb\x01ABOR"))
+	assert.Equal(t, "RETR \xff", stripTelnet("RETR \xff\xff"))
+	assert.Equal(t, "RETR caf\xc3\xa9", stripTelnet("RETR caf\xc3\xa9"))
+}
+
+func TestStat(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	assert.Nil(t, os.Mkdir(s.root+"/dir", 0755))
+
+	msg := s.expect("STAT", 211)
+	assert.Contains(t, msg, "Logged in as alice")
+	assert.Contains(t, msg, "TYPE: ASCII, STRU: F, MODE: S")
+
+	msg = s.expect("STAT /", 213)
+	assert.Contains(t, msg, " dir")
+}
+
+func TestAbort(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	s.expect("ABOR", 226)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	port := lis.Addr().(*net.TCPAddr).Port
+	s.expect(fmt.Sprintf("PORT 127,0,0,1,%d,%d", port>>8, port&0xFF), 200)
+	assert.Nil(t, s.conn.PrintfLine("STOR big.bin"))
+
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	code, _, _ := s.conn.ReadResponse(0)
+	assert.Equal(t, 150, code)
+	_, err = conn.Write([]byte("partial"))
+	assert.Nil(t, err)
+
+	// The upload is still in progress, since the data connection is open.
+	msg := s.expect("STAT", 213)
+	assert.Contains(t, msg, "STOR big.bin")
+
+	assert.Nil(t, s.conn.PrintfLine("\xff\xf4\xff\xf2ABOR"))
+	code, _, _ = s.conn.ReadResponse(0)
+	assert.Equal(t, 426, code)
+	code, _, _ = s.conn.ReadResponse(0)
+	assert.Equal(t, 226, code)
+
+	s.expect("NOOP", 200)
+}
+
+// interruptUpload starts uploading data to name, and aborts the upload once
+// the data has reached the file at p on disk.
+func (s *testSession) interruptUpload(name string, data []byte, p string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer lis.Close()
+
+	port := lis.Addr().(*net.TCPAddr).Port
+	s.expect(fmt.Sprintf("PORT 127,0,0,1,%d,%d", port>>8, port&0xFF), 200)
+	assert.Nil(s.t, s.conn.PrintfLine("STOR %s", name))
+
+	conn, err := lis.Accept()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer conn.Close()
+
+	code, _, _ := s.conn.ReadResponse(0)
+	assert.Equal(s.t, 150, code)
+	_, err = conn.Write(data)
+	assert.Nil(s.t, err)
+
+	assert.Eventually(s.t, func() bool {
+		stat, err := os.Stat(p)
+		return err == nil && stat.Size() == int64(len(data))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Nil(s.t, s.conn.PrintfLine("ABOR"))
+	code, _, _ = s.conn.ReadResponse(0)
+	assert.Equal(s.t, 426, code)
+	code, _, _ = s.conn.ReadResponse(0)
+	assert.Equal(s.t, 226, code)
+}
+
+func TestAtomicUpload(t *testing.T) {
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.AtomicUploads = true
+	})
+	defer cleanup()
+
+	assert.Nil(t, ioutil.WriteFile(s.root+"/report.txt", []byte("old"), 0644))
+
+	// The old contents stay in place until the upload completes.
+	s.expect("TYPE I", 200)
+	s.interruptUpload("report.txt", []byte("new, but"), s.root+"/.report.txt.part")
+	b, err := ioutil.ReadFile(s.root + "/report.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "old", string(b))
+	_, err = os.Stat(s.root + "/.report.txt.part")
+	assert.True(t, os.IsNotExist(err))
+
+	s.transfer("STOR report.txt", []byte("new"))
+	b, err = ioutil.ReadFile(s.root + "/report.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(b))
+	_, err = os.Stat(s.root + "/.report.txt.part")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestResumeAtomicUpload(t *testing.T) {
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.AtomicUploads = true
+		config.KeepPartialUploads = true
+	})
+	defer cleanup()
+
+	s.expect("TYPE I", 200)
+	s.interruptUpload("big.bin", []byte("first half, "), s.root+"/.big.bin.part")
+	assert.Equal(t, "12", s.expect("SIZE big.bin", 213))
+
+	s.expect("REST 12", 350)
+	s.transfer("STOR big.bin", []byte("second half"))
+	b, err := ioutil.ReadFile(s.root + "/big.bin")
+	assert.Nil(t, err)
+	assert.Equal(t, "first half, second half", string(b))
+	_, err = os.Stat(s.root + "/.big.bin.part")
+	assert.True(t, os.IsNotExist(err))
+
+	// When replacing a file, SIZE reports the file itself, and the partial
+	// upload is found under its own name.
+	s.interruptUpload("big.bin", []byte("new"), s.root+"/.big.bin.part")
+	assert.Equal(t, "23", s.expect("SIZE big.bin", 213))
+	assert.Equal(t, "3", s.expect("SIZE .big.bin.part", 213))
+
+	// A restart offset with nothing to resume is refused.
+	s.expect("REST 3", 350)
+	_, code, _ := s.tryTransfer("STOR other.bin", []byte("data"))
+	assert.Equal(t, 554, code)
+}
+
+func TestAtomicUploadLinkedPartial(t *testing.T) {
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.AtomicUploads = true
+	})
+	defer cleanup()
+
+	outside, err := ioutil.TempDir("", "charter-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	secret := filepath.Join(outside, "secret")
+	assert.Nil(t, ioutil.WriteFile(secret, []byte("secret"), 0644))
+	assert.Nil(t, os.Symlink(secret, s.root+"/.f.part"))
+	assert.Nil(t, os.Mkdir(s.root+"/.g.part", 0755))
+
+	_, code, _ := s.tryTransfer("STOR f", []byte("overwritten"))
+	assert.Equal(t, 550, code)
+	_, code, _ = s.tryTransfer("STOR g", []byte("data"))
+	assert.Equal(t, 550, code)
+
+	b, err := ioutil.ReadFile(secret)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", string(b))
+	_, err = os.Lstat(s.root + "/f")
+	assert.True(t, os.IsNotExist(err))
+}
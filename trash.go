@@ -0,0 +1,376 @@
+package charter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A user's trash is laid out like the freedesktop.org trash: removed files and
+// directories are kept under files, and for each of them, a file under info
+// records where it was removed from and when.
+const (
+	trashInfoSuffix = ".trashinfo"
+	trashInfoHeader = "[Trash Info]"
+	trashDateLayout = "2006-01-02T15:04:05"
+)
+
+var ErrNotInTrash = errors.New("no such entry in trash")
+
+// trashEntry is a file or directory in a user's trash.
+type trashEntry struct {
+	name    string // Name of the entry within the trash.
+	path    string // Virtual path the entry was removed from.
+	deleted time.Time
+}
+
+// trash is the trash of a single user, rooted at dir.
+type trash struct {
+	dir string
+}
+
+// trashFor returns the trash of the given user, if removed files are to be
+// moved to the trash.
+func (srv *Server) trashFor(user string) (trash, bool) {
+	if srv.config.TrashDir == "" || user == "" || user == "." || user == ".." {
+		return trash{}, false
+	}
+	return trash{dir: filepath.Join(srv.config.TrashDir, url.PathEscape(user))}, true
+}
+
+func (t trash) filesPath(name string) string {
+	return filepath.Join(t.dir, "files", name)
+}
+
+func (t trash) infoPath(name string) string {
+	return filepath.Join(t.dir, "info", name+trashInfoSuffix)
+}
+
+// add records that the file or directory at the virtual path vpath is being
+// moved to the trash, and returns the name under which it is to be stored. The
+// name is that of the file, with a number appended if it is already taken.
+func (t trash) add(vpath string, deleted time.Time) (string, error) {
+	for _, dir := range []string{"files", "info"} {
+		if err := os.MkdirAll(filepath.Join(t.dir, dir), 0700); err != nil {
+			return "", err
+		}
+	}
+
+	base := filepath.Base(filepath.FromSlash(vpath))
+	for i := 0; i < maxUniqueAttempts; i++ {
+		name := base
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", base, i)
+		}
+
+		f, err := os.OpenFile(t.infoPath(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		u := url.URL{Path: vpath}
+		_, err = fmt.Fprintf(f, "%s\nPath=%s\nDeletionDate=%s\n", trashInfoHeader,
+			u.EscapedPath(), deleted.UTC().Format(trashDateLayout))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = os.Remove(t.infoPath(name))
+			return "", err
+		}
+		return name, nil
+	}
+
+	return "", os.ErrExist
+}
+
+// lookup returns the entry stored under name.
+func (t trash) lookup(name string) (trashEntry, error) {
+	if name == "" || name != filepath.Base(name) {
+		return trashEntry{}, ErrNotInTrash
+	}
+
+	entry, err := readTrashInfo(t.infoPath(name))
+	if os.IsNotExist(err) {
+		return trashEntry{}, ErrNotInTrash
+	}
+	return entry, err
+}
+
+// list returns the entries in the trash, oldest first. Entries whose info
+// can't be read are left out.
+func (t trash) list() ([]trashEntry, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(t.dir, "info"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries []trashEntry
+	for _, fi := range infos {
+		if !strings.HasSuffix(fi.Name(), trashInfoSuffix) {
+			continue
+		}
+		entry, err := readTrashInfo(filepath.Join(t.dir, "info", fi.Name()))
+		if err == nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].deleted.Before(entries[j].deleted)
+	})
+	return entries, nil
+}
+
+// remove deletes the entry stored under name for good.
+func (t trash) remove(name string) error {
+	if err := os.RemoveAll(t.filesPath(name)); err != nil {
+		return err
+	}
+	return os.Remove(t.infoPath(name))
+}
+
+// purge deletes the entries removed before the given time, returning the
+// names of those deleted.
+func (t trash) purge(before time.Time) ([]string, error) {
+	entries, err := t.list()
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []string
+	for _, entry := range entries {
+		if !entry.deleted.Before(before) {
+			continue
+		}
+		if err := t.remove(entry.name); err != nil {
+			return purged, err
+		}
+		purged = append(purged, entry.name)
+	}
+	return purged, nil
+}
+
+// readTrashInfo reads the info file of a trash entry.
+func readTrashInfo(p string) (trashEntry, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return trashEntry{}, err
+	}
+	defer f.Close()
+
+	entry := trashEntry{name: strings.TrimSuffix(filepath.Base(p), trashInfoSuffix)}
+	scanner := bufio.NewScanner(io.LimitReader(f, 64*1024))
+	for scanner.Scan() {
+		key, value := splitKeyValue(scanner.Text())
+		switch key {
+		case "Path":
+			if entry.path, err = url.PathUnescape(value); err != nil {
+				return trashEntry{}, err
+			}
+		case "DeletionDate":
+			if entry.deleted, err = time.Parse(trashDateLayout, value); err != nil {
+				return trashEntry{}, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return trashEntry{}, err
+	}
+
+	if entry.path == "" || entry.deleted.IsZero() {
+		return trashEntry{}, fmt.Errorf("%s: malformed trash info", p)
+	}
+	return entry, nil
+}
+
+func splitKeyValue(line string) (key, value string) {
+	i := strings.IndexByte(line, '=')
+	if i < 0 {
+		return "", ""
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+}
+
+// moveToTrash moves the file or directory at realPath, whose virtual path is
+// vpath, to the user's trash. Its size is credited back to the quotas covering
+// it, since the trash lies outside the mounted directories.
+func (client *Client) moveToTrash(realPath, vpath string) error {
+	t, _ := client.server.trashFor(client.username)
+	name, err := t.add(vpath, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if err := client.moveFile(realPath, t.filesPath(name)); err != nil {
+		_ = os.Remove(t.infoPath(name))
+		return err
+	}
+	return nil
+}
+
+// trashEmptyDir moves the directory at realDir to the trash like moveToTrash,
+// but like rmdir(2), only if it is empty.
+func (client *Client) trashEmptyDir(realDir, vdir string) error {
+	f, err := client.openReal(realDir, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err == nil && !stat.IsDir() {
+		err = ErrNotDir
+	}
+	if err == nil {
+		if _, err = f.Readdirnames(1); err == io.EOF {
+			err = nil
+		} else if err == nil {
+			err = syscall.ENOTEMPTY
+		}
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	return client.moveToTrash(realDir, vdir)
+}
+
+// purgeTrash deletes the entries of every user's trash that are older than the
+// retention period.
+func (srv *Server) purgeTrash(now time.Time) {
+	users, err := ioutil.ReadDir(srv.config.TrashDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("charter: can't purge trash: %v", err)
+		}
+		return
+	}
+
+	before := now.AddDate(0, 0, -srv.config.TrashRetentionDays)
+	for _, fi := range users {
+		if !fi.IsDir() {
+			continue
+		}
+
+		t := trash{dir: filepath.Join(srv.config.TrashDir, fi.Name())}
+		purged, err := t.purge(before)
+		for _, name := range purged {
+			log.Printf("charter: purged %s from the trash of %s", name, fi.Name())
+		}
+		if err != nil {
+			log.Printf("charter: can't purge the trash of %s: %v", fi.Name(), err)
+		}
+	}
+}
+
+// siteTrashHandler handles SITE TRASH, which lists the entries in the user's
+// trash, or with EMPTY, deletes them for good.
+func siteTrashHandler(client *Client, command FtpCommand) (isExiting bool) {
+	t, ok := client.server.trashFor(client.username)
+	if !ok {
+		_ = client.sendReply(550, "The trash is disabled")
+		return
+	}
+
+	switch strings.ToUpper(strings.TrimSpace(command.Arg)) {
+	case "", "LIST":
+		entries, err := t.list()
+		if err != nil {
+			_ = client.sendReply(550, "Can't list the trash: %v", pathErr(err))
+			return
+		}
+		if len(entries) == 0 {
+			_ = client.sendReply(200, "The trash is empty")
+			return
+		}
+
+		lines := make([]string, len(entries))
+		for i, entry := range entries {
+			lines[i] = fmt.Sprintf("%s %s %s", entry.deleted.Format(timeValLayout), entry.name, entry.path)
+		}
+		_ = client.sendMultilineReply(200, "Trash of "+client.username+":", lines, "End")
+	case "EMPTY":
+		purged, err := t.purge(time.Now().Add(time.Second))
+		if err != nil {
+			_ = client.sendReply(550, "Can't empty the trash: %v", pathErr(err))
+			return
+		}
+		_ = client.sendReply(200, "Removed %d entries from the trash", len(purged))
+	default:
+		_ = client.sendReply(501, "Unknown SITE TRASH command %s", command.Arg)
+	}
+	return
+}
+
+// siteRestoreHandler handles SITE RESTORE, which moves an entry out of the
+// trash, back to where it was removed from or to the given path. Any missing
+// parent directories are created, but existing files are never replaced.
+func siteRestoreHandler(client *Client, command FtpCommand) (isExiting bool) {
+	start := time.Now()
+	arg := command.Value.(restoreArg)
+	t, ok := client.server.trashFor(client.username)
+	if !ok {
+		_ = client.sendReply(550, "The trash is disabled")
+		return
+	}
+
+	entry, err := t.lookup(arg.name)
+	if err != nil {
+		_ = client.sendReply(550, "Can't restore %s: %v", arg.name, err)
+		return
+	}
+
+	vdest := entry.path
+	if arg.dest != "" {
+		vdest = client.virtualPath(arg.dest)
+	}
+
+	realDest, err := client.writableLinkPath(vdest)
+	if err != nil {
+		_ = client.sendReply(550, "Can't restore to %s: %v", vdest, err)
+		return
+	}
+	if _, err := os.Lstat(realDest); err == nil {
+		_ = client.sendReply(553, "Can't restore to %s: %v", vdest, os.ErrExist)
+		return
+	}
+
+	// As with RNTO, links restored to a different depth mustn't end up
+	// pointing out of the mount.
+	if err := checkMovedLinks(client.rootOf(realDest), t.filesPath(entry.name), realDest); err != nil {
+		_ = client.sendReply(550, "Can't restore to %s: %v", vdest, pathErr(err))
+		return
+	}
+
+	if err := client.mkdirAllReal(filepath.Dir(realDest), client.dirPerm()); err != nil {
+		_ = client.sendReply(550, "Can't restore to %s: %v", vdest, pathErr(err))
+		return
+	}
+
+	if err := client.moveFile(t.filesPath(entry.name), realDest); err == ErrQuotaExceeded {
+		_ = client.sendReply(552, "Can't restore %s: Exceeded storage allocation", entry.name)
+		return
+	} else if err != nil {
+		_ = client.sendReply(550, "Can't restore %s: %v", entry.name, pathErr(err))
+		return
+	}
+	_ = os.Remove(t.infoPath(entry.name))
+
+	_ = client.sendReply(250, "Restored %s to %s", entry.name, vdest)
+	client.fireEvent(EventRestore, vdest, realDest, 0, start)
+	return
+}
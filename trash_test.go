@@ -0,0 +1,174 @@
+package charter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrash(t *testing.T) {
+	trashDir, err := ioutil.TempDir("", "charter-trash")
+	assert.Nil(t, err)
+	defer os.RemoveAll(trashDir)
+
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.TrashDir = trashDir
+		config.RecursiveDelete = true
+		config.Users = map[string]UserConf{"alice": {Quota: QuotaConf{Files: 3}}}
+	})
+	defer cleanup()
+
+	rmdirs := make(chan Event, 2)
+	s.srv.hooks.add(HookFunc(func(event Event) error {
+		rmdirs <- event
+		return nil
+	}), []string{EventRmdir})
+
+	makeTree(t, s.root)
+	s.expect("SITE QUOTA RESCAN", 200)
+	s.expect("SITE TRASH", 200)
+
+	s.expect("DELE project/README", 250)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(s.root, "project/README"), []byte("new"), 0644))
+	s.expect("DELE project/README", 250)
+	s.expect("RMD project/src", 550)
+	s.expect("RMD project/docs", 250)
+	s.expect("RMDA project/src", 250)
+	for _, want := range []int64{0, 8} {
+		select {
+		case event := <-rmdirs:
+			assert.Equal(t, want, event.Size, event.Path)
+		case <-time.After(5 * time.Second):
+			t.Fatal("hook wasn't called")
+		}
+	}
+
+	_, err = os.Stat(filepath.Join(s.root, "project/docs"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(trashDir, "alice/files/src/pkg/lib.go"))
+	assert.Nil(t, err)
+
+	msg := s.expect("SITE TRASH LIST", 200)
+	assert.Contains(t, msg, " README /project/README")
+	assert.Contains(t, msg, " README.1 /project/README")
+	assert.Contains(t, msg, " docs /project/docs")
+	assert.Contains(t, msg, " src /project/src")
+
+	// Trashed files no longer count against the quota, but restored ones do.
+	for _, name := range []string{"a", "project/README"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(s.root, name), []byte("data"), 0644))
+	}
+	assert.Contains(t, s.expect("SITE QUOTA RESCAN", 200), "2 of 3")
+	s.expect("SITE RESTORE README", 553)
+	s.expect("SITE RESTORE README \"old readme\"", 250)
+	b, err := ioutil.ReadFile(filepath.Join(s.root, "old readme"))
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(b))
+	s.expect("SITE RESTORE README", 550)
+	s.expect("SITE RESTORE ../README.1", 550)
+
+	s.expect("SITE RESTORE src", 552)
+	s.expect("SITE RESTORE docs", 250)
+	stat, err := os.Stat(filepath.Join(s.root, "project/docs"))
+	assert.Nil(t, err)
+	assert.True(t, stat.IsDir())
+
+	assert.Contains(t, s.expect("SITE TRASH EMPTY", 200), "Removed 2 entries")
+	assert.Equal(t, "The trash is empty", s.expect("SITE TRASH", 200))
+	s.expect("SITE TRASH BOGUS", 501)
+}
+
+func TestRestoreLinks(t *testing.T) {
+	trashDir, err := ioutil.TempDir("", "charter-trash")
+	assert.Nil(t, err)
+	defer os.RemoveAll(trashDir)
+
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.TrashDir = trashDir
+		config.AllowSymlinks = true
+	})
+	defer cleanup()
+
+	assert.Nil(t, os.MkdirAll(filepath.Join(s.root, "a/b"), 0755))
+	assert.Nil(t, os.Symlink("../../t.txt", filepath.Join(s.root, "a/b/link")))
+	s.expect("DELE a/b/link", 250)
+
+	// The link only stays inside the mount at its original depth.
+	s.expect("SITE RESTORE link /link", 550)
+	s.expect("SITE RESTORE link /c/d/link", 250)
+	target, err := os.Readlink(filepath.Join(s.root, "c/d/link"))
+	assert.Nil(t, err)
+	assert.Equal(t, "../../t.txt", target)
+}
+
+func TestTrashOtherFileSystem(t *testing.T) {
+	trashDir, err := ioutil.TempDir("/dev/shm", "charter-trash")
+	if err != nil {
+		t.Skip("no tmpfs at /dev/shm")
+	}
+	defer os.RemoveAll(trashDir)
+
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.TrashDir = trashDir
+		config.RecursiveDelete = true
+		config.Users = map[string]UserConf{"alice": {Quota: QuotaConf{Files: 3}}}
+	})
+	defer cleanup()
+
+	makeTree(t, s.root)
+	if err := os.Rename(filepath.Join(s.root, "project/README"), filepath.Join(trashDir, "README")); err == nil {
+		t.Skip("trash is on the same file system")
+	}
+
+	s.expect("SITE QUOTA RESCAN", 200)
+	s.expect("RMDA project/src", 250)
+	_, err = os.Stat(filepath.Join(s.root, "project/src"))
+	assert.True(t, os.IsNotExist(err))
+	b, err := ioutil.ReadFile(filepath.Join(trashDir, "alice/files/src/pkg/lib.go"))
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(b))
+	assert.Contains(t, s.expect("SITE QUOTA", 200), "1 of 3")
+
+	s.expect("SITE RESTORE src", 250)
+	_, err = os.Stat(filepath.Join(s.root, "project/src/pkg/lib.go"))
+	assert.Nil(t, err)
+	assert.Contains(t, s.expect("SITE QUOTA", 200), "3 of 3")
+}
+
+func TestTrashDisabled(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	s.expect("SITE TRASH", 550)
+	s.expect("SITE RESTORE a.txt", 550)
+}
+
+func TestPurgeTrash(t *testing.T) {
+	trashDir, err := ioutil.TempDir("", "charter-trash")
+	assert.Nil(t, err)
+	defer os.RemoveAll(trashDir)
+
+	srv := NewServer(&Config{TrashDir: trashDir, TrashRetentionDays: 30})
+	tr, ok := srv.trashFor("bob")
+	assert.True(t, ok)
+
+	now := time.Now()
+	for vpath, age := range map[string]int{"/old": 31, "/recent": 29} {
+		name, err := tr.add(vpath, now.AddDate(0, 0, -age))
+		assert.Nil(t, err)
+		assert.Nil(t, ioutil.WriteFile(tr.filesPath(name), []byte("data"), 0644))
+	}
+
+	srv.purgeTrash(now)
+	entries, err := tr.list()
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "/recent", entries[0].path)
+	}
+	_, err = os.Stat(tr.filesPath("old"))
+	assert.True(t, os.IsNotExist(err))
+}
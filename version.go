@@ -0,0 +1,114 @@
+package charter
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// versionsDirName is the hidden directory, next to each versioned file, that
+// holds its previous versions. The most recent one is name.1, the one before
+// name.2, and so on.
+const versionsDirName = ".versions"
+
+func versionPath(filename string, n int) string {
+	return filepath.Join(filepath.Dir(filename), versionsDirName, fmt.Sprintf("%s.%d", filepath.Base(filename), n))
+}
+
+// versionsDir returns the directory holding the previous versions of the real
+// path filename. Since it is reached without going through the resolver, it is
+// refused if it is anything but a directory, so that a link planted in its
+// place can't lead versions out of the tree.
+func versionsDir(filename string) (string, error) {
+	dir := filepath.Join(filepath.Dir(filename), versionsDirName)
+	stat, err := os.Lstat(dir)
+	switch {
+	case err != nil:
+		return dir, err
+	case stat.Mode()&os.ModeSymlink != 0:
+		return "", ErrSymlinkNotAllowed
+	case !stat.IsDir():
+		return "", ErrNotDir
+	}
+	return dir, nil
+}
+
+// saveVersion moves the regular file filename aside as its most recent version
+// before it is replaced, shifting the older versions down and removing the one
+// beyond the number kept. Versions stay in the mounted tree, so they count
+// against quotas like any other file.
+func (client *Client) saveVersion(filename string) error {
+	keep := client.server.config.Versions
+	if keep <= 0 {
+		return nil
+	}
+
+	stat, err := os.Lstat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if !stat.Mode().IsRegular() {
+		return nil
+	}
+
+	root := client.rootOf(filename)
+	dir, err := versionsDir(filename)
+	if os.IsNotExist(err) {
+		err = mkdirBeneath(root, dir, client.dirPerm())
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := client.removeFile(versionPath(filename, keep)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := keep - 1; n > 0; n-- {
+		err := renameBeneath(root, versionPath(filename, n), root, versionPath(filename, n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return renameBeneath(root, filename, root, versionPath(filename, 1))
+}
+
+// siteVersionsHandler handles SITE VERSIONS, which lists the previous versions
+// of a file, most recent first, along with the paths from which they can be
+// retrieved.
+func siteVersionsHandler(client *Client, command FtpCommand) (isExiting bool) {
+	paramPath := strings.TrimSpace(command.Arg)
+	realPath, err := client.realPath(paramPath)
+	if err != nil {
+		_ = client.sendReply(550, "Can't list versions of %s: %v", paramPath, err)
+		return
+	}
+
+	vpath := client.virtualPath(paramPath)
+	if _, err := versionsDir(realPath); err != nil && !os.IsNotExist(err) {
+		_ = client.sendReply(550, "Can't list versions of %s: %v", paramPath, pathErr(err))
+		return
+	}
+
+	var lines []string
+	for n := 1; ; n++ {
+		stat, err := os.Lstat(versionPath(realPath, n))
+		if err != nil || !stat.Mode().IsRegular() {
+			break
+		}
+
+		vversion := path.Join(path.Dir(vpath), versionsDirName, fmt.Sprintf("%s.%d", path.Base(vpath), n))
+		lines = append(lines, fmt.Sprintf("%d %s %d %s", n,
+			stat.ModTime().UTC().Format(timeValLayout), stat.Size(), vversion))
+	}
+
+	if len(lines) == 0 {
+		_ = client.sendReply(200, "No previous versions of %s", vpath)
+		return
+	}
+	_ = client.sendMultilineReply(200, "Versions of "+vpath+":", lines, "End")
+	return
+}
@@ -0,0 +1,105 @@
+package charter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersions(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		s, cleanup := newTestSession(t, func(config *Config) {
+			config.Versions = 2
+			config.AtomicUploads = atomic
+		})
+
+		s.expect("TYPE I", 200)
+		s.expect("SITE VERSIONS report.csv", 200)
+		for _, content := range []string{"first", "second", "third", "fourth"} {
+			code, _ := s.transfer("STOR report.csv", []byte(content))
+			assert.Equal(t, 226, code)
+		}
+
+		for name, content := range map[string]string{
+			"report.csv":             "fourth",
+			".versions/report.csv.1": "third",
+			".versions/report.csv.2": "second",
+		} {
+			b, err := ioutil.ReadFile(filepath.Join(s.root, name))
+			assert.Nil(t, err)
+			assert.Equal(t, content, string(b))
+		}
+		_, err := os.Stat(filepath.Join(s.root, ".versions/report.csv.3"))
+		assert.True(t, os.IsNotExist(err))
+
+		msg := s.expect("SITE VERSIONS report.csv", 200)
+		assert.Contains(t, msg, " 5 /.versions/report.csv.1")
+		assert.Contains(t, msg, " 6 /.versions/report.csv.2")
+
+		_, b := s.transfer("RETR .versions/report.csv.2", nil)
+		assert.Equal(t, "second", string(b))
+		s.expect("SITE VERSIONS missing.csv", 200)
+
+		cleanup()
+	}
+}
+
+func TestVersionsDisabled(t *testing.T) {
+	s, cleanup := newTestSession(t, nil)
+	defer cleanup()
+
+	s.expect("TYPE I", 200)
+	s.transfer("STOR a.txt", []byte("first"))
+	s.transfer("STOR a.txt", []byte("second"))
+	_, err := os.Stat(filepath.Join(s.root, versionsDirName))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestVersionsLinkedDir(t *testing.T) {
+	outside, err := ioutil.TempDir("", "charter-outside")
+	assert.Nil(t, err)
+	defer os.RemoveAll(outside)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(outside, "f.1"), []byte("host"), 0644))
+
+	s, cleanup := newTestSession(t, func(config *Config) {
+		config.Versions = 2
+	})
+	defer cleanup()
+
+	assert.Nil(t, os.Symlink(outside, filepath.Join(s.root, versionsDirName)))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(s.root, "f"), []byte("old"), 0644))
+
+	s.expect("TYPE I", 200)
+	_, code, _ := s.tryTransfer("STOR f", []byte("new"))
+	assert.Equal(t, 550, code)
+	s.expect("SITE VERSIONS f", 550)
+
+	b, err := ioutil.ReadFile(filepath.Join(s.root, "f"))
+	assert.Nil(t, err)
+	assert.Equal(t, "old", string(b))
+	b, err = ioutil.ReadFile(filepath.Join(outside, "f.1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "host", string(b))
+}
+
+func TestVersionsStou(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		s, cleanup := newTestSession(t, func(config *Config) {
+			config.Versions = 2
+			config.AtomicUploads = atomic
+			config.Users = map[string]UserConf{"alice": {Quota: QuotaConf{Files: 2}}}
+		})
+
+		s.expect("TYPE I", 200)
+		code, _ := s.transfer("STOU scan.txt", []byte("scan"))
+		assert.Equal(t, 226, code)
+		_, err := os.Stat(filepath.Join(s.root, versionsDirName))
+		assert.True(t, os.IsNotExist(err))
+		assert.Contains(t, s.expect("SITE QUOTA", 200), "1 of 2 files")
+
+		cleanup()
+	}
+}